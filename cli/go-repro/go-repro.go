@@ -1,29 +1,60 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/mayflower/go-repro/lib"
 )
 
-func parseCommandline() (cfg lib.Config, err error) {
+func parseCommandline() (cfg lib.Config, configFile string, err error) {
 	var (
 		mappingDefs, rewriteDefs string
+		wildcardDefs             string
 		sslAllowInsecure         bool
 		noLogging                bool
 		showVersion              bool
-		configFile               string
+		caDir                    string
+		onboarding               bool
+		rewriteWebsockets        bool
+		scopeCookieDomain        bool
+		stripHsts                bool
+		virtualHosting           string
+		discovery                bool
+		discoveryHosts           string
+		discoveryPorts           string
+		adminAddress             string
+		drainTimeout             time.Duration
+		recordingDir             string
+		recordingMaxSize         int64
 	)
 
-	flag.StringVar(&mappingDefs, "mappings", "", "mapping definitions, format: local=remote,[local=remote,...]")
+	flag.StringVar(&mappingDefs, "mappings", "", "mapping definitions, format: [https://]local=remote,[[https://]local=remote,...]")
+	flag.StringVar(&wildcardDefs, "wildcard-mappings", "", "wildcard mapping definitions, format: [https://]ip:first-last=scheme://*.domain,...")
 	flag.StringVar(&rewriteDefs, "rewrite", "", "comma-separated list of regexes indetifying routes whose response will be rewritten")
 	flag.BoolVar(&sslAllowInsecure, "allow-insecure", false, "accept insecure upstream connections")
 	flag.BoolVar(&noLogging, "no-logging", false, "disable logging via x-go-repro-log headers")
-	flag.StringVar(&configFile, "config", "", "read YAML config from file (all other options are ignored)")
+	flag.StringVar(&caDir, "ca-dir", lib.DefaultCADir(), "directory holding the CA used for local TLS mappings")
+	flag.BoolVar(&onboarding, "onboarding", false, "serve CA certificate and mapping overview below /.go-repro/")
+	flag.BoolVar(&rewriteWebsockets, "rewrite-websockets", false, "apply host mappings to websocket text frames")
+	flag.BoolVar(&scopeCookieDomain, "scope-cookie-domain", false, "scope cookies to the local host name instead of dropping their domain")
+	flag.BoolVar(&stripHsts, "strip-hsts", false, "remove strict-transport-security headers from responses")
+	flag.StringVar(&virtualHosting, "virtual-hosts", "", "distinguish mappings sharing a local address by \"path\", \"host\" or \"nip.io\"")
+	flag.BoolVar(&discovery, "discover", false, "report unmapped hosts referenced by responses")
+	flag.StringVar(&discoveryHosts, "discover-hosts", "", "comma-separated list of host patterns to map when discovered, e.g. *.partner.com")
+	flag.StringVar(&discoveryPorts, "discover-ports", "", "port range for discovered hosts, format: [https://]ip:first-last")
+	flag.StringVar(&adminAddress, "admin", "", "serve the admin API for changing mappings at runtime, format: [ip:]port")
+	flag.DurationVar(&drainTimeout, "drain-timeout", lib.DefaultDrainTimeout, "how long active requests may take to complete on shutdown")
+	flag.StringVar(&recordingDir, "record", "", "record all exchanges as HAR files in the directory")
+	flag.Int64Var(&recordingMaxSize, "record-max-size", 0, "start a new HAR file once the current one exceeds the size in MiB")
+	flag.StringVar(&configFile, "config", "", "read YAML config from file and reload it on changes (all other options are ignored)")
 	flag.BoolVar(&showVersion, "version", false, "display version")
 
 	flag.Usage = func() {
@@ -50,8 +81,34 @@ func parseCommandline() (cfg lib.Config, err error) {
 		cfg = lib.NewConfig()
 		cfg.SetSSLAllowInsecure(sslAllowInsecure)
 		cfg.SetNoLogging(noLogging)
+		cfg.SetCADir(caDir)
+		cfg.SetOnboarding(onboarding)
+		cfg.SetRewriteWebsockets(rewriteWebsockets)
+		cfg.SetScopeCookieDomain(scopeCookieDomain)
+		cfg.SetStripHsts(stripHsts)
+		cfg.SetDiscovery(discovery)
+		cfg.SetAdminAddress(adminAddress)
+		cfg.SetDrainTimeout(drainTimeout)
+		cfg.SetRecording(recordingDir)
+		cfg.SetRecordingMaxSize(recordingMaxSize << 20)
+
+		err = cfg.SetVirtualHosting(virtualHosting)
 
-		err = addMappings(mappingDefs, &cfg)
+		if err == nil {
+			err = addMappings(mappingDefs, &cfg)
+		}
+
+		if err == nil {
+			err = addWildcardMappings(wildcardDefs, &cfg)
+		}
+
+		if err == nil {
+			err = addDiscoveryHosts(discoveryHosts, &cfg)
+		}
+
+		if err == nil && discoveryPorts != "" {
+			err = cfg.SetDiscoveryPorts(discoveryPorts)
+		}
 
 		if err == nil {
 			err = addRewrites(rewriteDefs, &cfg)
@@ -83,6 +140,44 @@ func addMappings(def string, cfg *lib.Config) (err error) {
 	return
 }
 
+func addWildcardMappings(def string, cfg *lib.Config) (err error) {
+	if def == "" {
+		return
+	}
+
+	for _, definition := range strings.Split(def, ",") {
+		parts := strings.Split(definition, "=")
+
+		if len(parts) != 2 {
+			err = errors.New(fmt.Sprintf("syntax error in wildcard mapping: %s", def))
+		} else {
+			err = cfg.AddWildcardMapping(parts[0], parts[1])
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func addDiscoveryHosts(def string, cfg *lib.Config) (err error) {
+	if def == "" {
+		return
+	}
+
+	for _, pattern := range strings.Split(def, ",") {
+		err = cfg.AddDiscoveryHost(pattern)
+
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
 func addRewrites(def string, cfg *lib.Config) (err error) {
 	if def == "" {
 		return
@@ -102,7 +197,7 @@ func addRewrites(def string, cfg *lib.Config) (err error) {
 func main() {
 	var err error
 
-	cfg, err := parseCommandline()
+	cfg, configFile, err := parseCommandline()
 
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n\n", err)
@@ -110,7 +205,8 @@ func main() {
 		os.Exit(1)
 	}
 
-	if cfg.CountMappings() == 0 {
+	// Mappings may still be added via the admin API
+	if cfg.CountMappings() == 0 && cfg.AdminAddress() == "" {
 		fmt.Println("nothing to do")
 		return
 	}
@@ -122,8 +218,21 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = <-r.Start(); err != nil {
-		fmt.Println(err)
+	// A second signal terminates immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if configFile != "" {
+		go watchConfig(ctx, configFile, r)
+	}
+
+	if err = r.Run(ctx, cfg.DrainTimeout()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/mayflower/go-repro/lib"
+)
+
+const configPollInterval = time.Second
+
+// Reloads the config file when it is modified or on SIGHUP
+func watchConfig(ctx context.Context, fname string, r *lib.Repro) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	modified := modificationTime(fname)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-signals:
+		case <-ticker.C:
+			if modificationTime(fname).Equal(modified) {
+				continue
+			}
+		}
+
+		modified = modificationTime(fname)
+
+		if err := reloadConfig(fname, r); err != nil {
+			fmt.Fprintf(os.Stderr, "config reload failed: %v\n", err)
+		}
+	}
+}
+
+func modificationTime(fname string) (t time.Time) {
+	if info, err := os.Stat(fname); err == nil {
+		t = info.ModTime()
+	}
+
+	return
+}
+
+func reloadConfig(fname string, r *lib.Repro) (err error) {
+	yamlConfig, err := UnmarshalYamlConfigFile(fname)
+
+	if err != nil {
+		return
+	}
+
+	cfg, err := yamlConfig.createReproConfig()
+
+	if err != nil {
+		return
+	}
+
+	return r.Reload(cfg)
+}
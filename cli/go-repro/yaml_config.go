@@ -3,20 +3,66 @@ package main
 import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"time"
 
 	"github.com/mayflower/go-repro/lib"
 )
 
 type YamlConfig struct {
-	Mappings      []YamlMapping `yaml:"mappings"`
-	Rewrites      []string      `yaml:"rewrites"`
-	AllowInsecure bool          `yaml:"allow-insecure"`
-	NoLogging     bool          `yaml:"disable-logging"`
+	Mappings          []YamlMapping `yaml:"mappings"`
+	WildcardMappings  []YamlMapping `yaml:"wildcard-mappings"`
+	Rewrites          []string      `yaml:"rewrites"`
+	AllowInsecure     bool          `yaml:"allow-insecure"`
+	NoLogging         bool          `yaml:"disable-logging"`
+	CADir             string        `yaml:"ca-dir"`
+	Onboarding        bool          `yaml:"onboarding"`
+	RewriteWebsockets bool          `yaml:"rewrite-websockets"`
+	ScopeCookieDomain bool          `yaml:"scope-cookie-domain"`
+	StripHsts         bool          `yaml:"strip-hsts"`
+	VirtualHosts      string        `yaml:"virtual-hosts"`
+	Discovery         YamlDiscovery `yaml:"discovery"`
+	Admin             string        `yaml:"admin"`
+	DrainTimeout      string        `yaml:"drain-timeout"`
+	Recording         YamlRecording `yaml:"recording"`
+	RewriteHeaders    YamlHeaders   `yaml:"rewrite-headers"`
+	Rules             []YamlRule    `yaml:"rules"`
+}
+
+type YamlRule struct {
+	Name        string `yaml:"name"`
+	Route       string `yaml:"route"`
+	ContentType string `yaml:"content-type"`
+	Target      string `yaml:"target"`
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+}
+
+type YamlDiscovery struct {
+	Enabled bool     `yaml:"enabled"`
+	Hosts   []string `yaml:"hosts"`
+	Ports   string   `yaml:"ports"`
+}
+
+type YamlRecording struct {
+	Dir     string `yaml:"dir"`
+	MaxSize int64  `yaml:"max-size"`
+}
+
+type YamlHeaders struct {
+	Outgoing []string `yaml:"outgoing"`
+	Incoming []string `yaml:"incoming"`
 }
 
 type YamlMapping struct {
-	Local  string `yaml:"local"`
-	Remote string `yaml:"remote"`
+	Local          string            `yaml:"local"`
+	Remote         string            `yaml:"remote"`
+	Rewrites       []string          `yaml:"rewrites"`
+	AllowInsecure  *bool             `yaml:"allow-insecure"`
+	NoLogging      *bool             `yaml:"disable-logging"`
+	Timeout        string            `yaml:"timeout"`
+	Headers        map[string]string `yaml:"headers"`
+	RewriteHeaders YamlHeaders       `yaml:"rewrite-headers"`
+	Rewriters      []string          `yaml:"rewriters"`
 }
 
 func UnmarshalYamlConfigBuffer(buffer []byte) (config YamlConfig, err error) {
@@ -41,13 +87,41 @@ func (c *YamlConfig) createReproConfig() (cfg lib.Config, err error) {
 	cfg = lib.NewConfig()
 
 	for _, mapping := range c.Mappings {
-		err = cfg.AddMapping(mapping.Local, mapping.Remote)
+		var options *lib.MappingOptions
+
+		options, err = mapping.createMappingOptions()
+
+		if err == nil {
+			err = cfg.AddMappingWithOptions(mapping.Local, mapping.Remote, options)
+		}
 
 		if err != nil {
 			return
 		}
 	}
 
+	for _, mapping := range c.WildcardMappings {
+		err = cfg.AddWildcardMapping(mapping.Local, mapping.Remote)
+
+		if err != nil {
+			return
+		}
+	}
+
+	for _, pattern := range c.Discovery.Hosts {
+		err = cfg.AddDiscoveryHost(pattern)
+
+		if err != nil {
+			return
+		}
+	}
+
+	if c.Discovery.Ports != "" {
+		if err = cfg.SetDiscoveryPorts(c.Discovery.Ports); err != nil {
+			return
+		}
+	}
+
 	for _, rewritePattern := range c.Rewrites {
 		err = cfg.AddRewriteRoute(rewritePattern)
 
@@ -56,8 +130,112 @@ func (c *YamlConfig) createReproConfig() (cfg lib.Config, err error) {
 		}
 	}
 
+	for _, rule := range c.Rules {
+		err = cfg.AddRule(rule.Name, rule.Route, rule.ContentType, rule.Target, rule.Pattern, rule.Replacement)
+
+		if err != nil {
+			return
+		}
+	}
+
+	for _, header := range c.RewriteHeaders.Outgoing {
+		cfg.AddRewriteHeader(header)
+	}
+
+	for _, header := range c.RewriteHeaders.Incoming {
+		cfg.AddRewriteIncomingHeader(header)
+	}
+
 	cfg.SetSSLAllowInsecure(c.AllowInsecure)
 	cfg.SetNoLogging(c.NoLogging)
+	cfg.SetOnboarding(c.Onboarding)
+	cfg.SetRewriteWebsockets(c.RewriteWebsockets)
+	cfg.SetScopeCookieDomain(c.ScopeCookieDomain)
+	cfg.SetStripHsts(c.StripHsts)
+	cfg.SetDiscovery(c.Discovery.Enabled)
+	cfg.SetAdminAddress(c.Admin)
+	cfg.SetRecording(c.Recording.Dir)
+	cfg.SetRecordingMaxSize(c.Recording.MaxSize << 20)
+
+	if err = cfg.SetVirtualHosting(c.VirtualHosts); err != nil {
+		return
+	}
+
+	if c.CADir != "" {
+		cfg.SetCADir(c.CADir)
+	}
+
+	if c.DrainTimeout != "" {
+		var timeout time.Duration
+
+		if timeout, err = time.ParseDuration(c.DrainTimeout); err != nil {
+			return
+		}
+
+		cfg.SetDrainTimeout(timeout)
+	}
+
+	return
+}
+
+func (m *YamlMapping) createMappingOptions() (options *lib.MappingOptions, err error) {
+	options = lib.NewMappingOptions()
+
+	if m.Rewrites != nil {
+		options.ClearRewriteRoutes()
+	}
+
+	for _, rewritePattern := range m.Rewrites {
+		err = options.AddRewriteRoute(rewritePattern)
+
+		if err != nil {
+			return
+		}
+	}
+
+	if m.AllowInsecure != nil {
+		options.SetSSLAllowInsecure(*m.AllowInsecure)
+	}
+
+	if m.NoLogging != nil {
+		options.SetNoLogging(*m.NoLogging)
+	}
+
+	if m.Timeout != "" {
+		var timeout time.Duration
+
+		timeout, err = time.ParseDuration(m.Timeout)
+
+		if err != nil {
+			return
+		}
+
+		options.SetTimeout(timeout)
+	}
+
+	for key, value := range m.Headers {
+		options.AddRequestHeader(key, value)
+	}
+
+	for _, header := range m.RewriteHeaders.Outgoing {
+		options.AddRewriteHeader(header)
+	}
+
+	for _, header := range m.RewriteHeaders.Incoming {
+		options.AddRewriteIncomingHeader(header)
+	}
+
+	if m.Rewriters != nil {
+		options.ClearRewriters()
+	}
+
+	for _, name := range m.Rewriters {
+		err = options.EnableRewriter(name)
+
+		if err != nil {
+			return
+		}
+	}
 
 	return
 }
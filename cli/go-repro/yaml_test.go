@@ -2,6 +2,7 @@ package main
 
 import (
 	"testing"
+	"time"
 )
 
 func TestScalars(t *testing.T) {
@@ -159,3 +160,301 @@ func TestBadYaml(t *testing.T) {
 		t.Fatal("bad YAML should not parse")
 	}
 }
+
+func TestRewriteHeaders(t *testing.T) {
+	fixture := `
+        rewrite-headers:
+            outgoing:
+                - Link
+                - x-callback-url
+            incoming:
+                - x-return-to
+    `
+
+	parsed, err := UnmarshalYamlConfigBuffer([]byte(fixture))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := parsed.createReproConfig()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.RewriteHeaders()) != 2 || cfg.RewriteHeaders()[0] != "link" {
+		t.Fatalf("outgoing headers failed to propagate: %v", cfg.RewriteHeaders())
+	}
+
+	if len(cfg.RewriteIncomingHeaders()) != 1 || cfg.RewriteIncomingHeaders()[0] != "x-return-to" {
+		t.Fatalf("incoming headers failed to propagate: %v", cfg.RewriteIncomingHeaders())
+	}
+}
+
+func TestRules(t *testing.T) {
+	fixture := `
+        rules:
+            - name: enable checkout
+              route: /api/config
+              content-type: application/json
+              target: json:features.checkout
+              pattern: "false"
+              replacement: "true"
+            - target: header:x-api-key
+              pattern: ^prod-
+              replacement: staging-
+    `
+
+	badFixture := `
+        rules:
+            - target: cookie:session
+              pattern: a
+    `
+
+	parsed, err := UnmarshalYamlConfigBuffer([]byte(fixture))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(parsed.Rules) != 2 || parsed.Rules[0].Name != "enable checkout" || parsed.Rules[1].Pattern != "^prod-" {
+		t.Fatalf("rules failed to parse: %v", parsed)
+	}
+
+	cfg, err := parsed.createReproConfig()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.CountRules() != 2 {
+		t.Fatal("rules failed to propagate")
+	}
+
+	parsedBad, err := UnmarshalYamlConfigBuffer([]byte(badFixture))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = parsedBad.createReproConfig(); err == nil {
+		t.Fatal("invalid rule accepted")
+	}
+}
+
+func TestMappingOptions(t *testing.T) {
+	fixture := `
+        rewrites:
+            - .
+        mappings:
+            - local: localhost:1234
+              remote: http://foo.bar
+              rewrites: []
+              allow-insecure: true
+              timeout: 10s
+              headers:
+                  authorization: Bearer abc
+              rewriters:
+                  - location
+                  - json
+            - local: localhost:1235
+              remote: http://bar.foo
+            - local: localhost:1236
+              remote: http://baz.foo
+              rewriters: []
+    `
+
+	parsed, err := UnmarshalYamlConfigBuffer([]byte(fixture))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapping := parsed.Mappings[0]
+
+	if mapping.Rewrites == nil || mapping.AllowInsecure == nil || !*mapping.AllowInsecure ||
+		mapping.Timeout != "10s" || mapping.Headers["authorization"] != "Bearer abc" || len(mapping.Rewriters) != 2 {
+
+		t.Fatalf("mapping options failed to parse: %v", mapping)
+	}
+
+	if parsed.Mappings[1].AllowInsecure != nil || parsed.Mappings[1].Rewrites != nil || parsed.Mappings[1].Rewriters != nil {
+		t.Fatalf("unset options should stay unset: %v", parsed.Mappings[1])
+	}
+
+	if parsed.Mappings[2].Rewriters == nil || len(parsed.Mappings[2].Rewriters) != 0 {
+		t.Fatalf("empty rewriters should be kept: %v", parsed.Mappings[2])
+	}
+
+	if _, err = parsed.createReproConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range []YamlMapping{
+		{Local: "localhost:1234", Remote: "http://foo.bar", Timeout: "soon"},
+		{Local: "localhost:1234", Remote: "http://foo.bar", Rewriters: []string{"magic"}},
+		{Local: "localhost:1234", Remote: "http://foo.bar", Rewrites: []string{"("}},
+	} {
+		config := YamlConfig{Mappings: []YamlMapping{bad}}
+
+		if _, err = config.createReproConfig(); err == nil {
+			t.Fatalf("invalid mapping options accepted: %v", bad)
+		}
+	}
+}
+
+func TestVirtualHosts(t *testing.T) {
+	fixture := `
+        virtual-hosts: nip.io
+        mappings:
+          - local: 0.0.0.0:8080
+            remote: https://shop.app.dev
+          - local: 0.0.0.0:8080
+            remote: https://api.app.dev
+    `
+
+	parsed, err := UnmarshalYamlConfigBuffer([]byte(fixture))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := parsed.createReproConfig()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.VirtualHosting() != "nip.io" {
+		t.Fatalf("virtual-hosts failed to propagate: %s", cfg.VirtualHosting())
+	}
+
+	parsed.VirtualHosts = "dns"
+
+	if _, err = parsed.createReproConfig(); err == nil {
+		t.Fatal("unknown virtual hosting mode should be an error")
+	}
+}
+
+func TestWildcardMappings(t *testing.T) {
+	fixture := `
+        wildcard-mappings:
+          - local: 0.0.0.0:9000-9099
+            remote: https://*.app.dev
+    `
+
+	parsed, err := UnmarshalYamlConfigBuffer([]byte(fixture))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := parsed.createReproConfig()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.CountWildcardMappings() != 1 {
+		t.Fatalf("expected 1 wildcard mapping, got %d", cfg.CountWildcardMappings())
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	fixture := `
+        discovery:
+          enabled: true
+          hosts:
+            - "*.partner.com"
+          ports: 0.0.0.0:9100-9199
+    `
+
+	parsed, err := UnmarshalYamlConfigBuffer([]byte(fixture))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := parsed.createReproConfig()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cfg.Discovery() {
+		t.Fatal("discovery failed to propagate")
+	}
+
+	parsed.Discovery.Ports = "0.0.0.0:9100"
+
+	if _, err = parsed.createReproConfig(); err == nil {
+		t.Fatal("port without range should be an error")
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	parsed, err := UnmarshalYamlConfigBuffer([]byte("admin: 9901"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := parsed.createReproConfig()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.AdminAddress() != "127.0.0.1:9901" {
+		t.Fatalf("unexpected admin address %s", cfg.AdminAddress())
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	parsed, err := UnmarshalYamlConfigBuffer([]byte("drain-timeout: 30s"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := parsed.createReproConfig()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.DrainTimeout() != 30*time.Second {
+		t.Fatalf("unexpected drain timeout %v", cfg.DrainTimeout())
+	}
+
+	parsed.DrainTimeout = "soon"
+
+	if _, err = parsed.createReproConfig(); err == nil {
+		t.Fatal("invalid duration should be an error")
+	}
+}
+
+func TestRecording(t *testing.T) {
+	fixture := `
+        recording:
+          dir: recordings
+          max-size: 50
+    `
+
+	parsed, err := UnmarshalYamlConfigBuffer([]byte(fixture))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := parsed.createReproConfig()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Recording() != "recordings" || cfg.RecordingMaxSize() != 50<<20 {
+		t.Fatalf("unexpected recording %s, %d", cfg.Recording(), cfg.RecordingMaxSize())
+	}
+}
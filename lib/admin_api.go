@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// A JSON API for changing the mappings at runtime. It is not authenticated,
+// so it is bound to localhost by default and rejects cross-site requests.
+type adminApi struct {
+	repro  *Repro
+	server http.Server
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func newAdminApi(r *Repro, address string) *adminApi {
+	a := &adminApi{repro: r}
+
+	a.server.Addr = address
+	a.server.Handler = a
+
+	return a
+}
+
+func (a *adminApi) Start() <-chan error {
+	c := make(chan error, 1)
+
+	go func() {
+		err := a.server.ListenAndServe()
+
+		if err != http.ErrServerClosed {
+			err = errors.New(fmt.Sprintf("admin API on %s: %v", a.server.Addr, err))
+		}
+
+		c <- err
+	}()
+
+	fmt.Fprintf(a.repro.log, "serving admin API on http://%s\n", a.server.Addr)
+
+	return c
+}
+
+func (a *adminApi) ServeHTTP(outgoing http.ResponseWriter, incoming *http.Request) {
+	if incoming.URL.Path != "/mappings" {
+		writeJson(outgoing, http.StatusNotFound, adminError{"not found"})
+		return
+	}
+
+	if !a.allowsHost(incoming.Host) {
+		writeJson(outgoing, http.StatusForbidden, adminError{"host not allowed"})
+		return
+	}
+
+	// Browsers send a preflight for JSON, so other sites cannot change mappings
+	if incoming.Method != http.MethodGet && !isJsonContentType(incoming.Header.Get("content-type")) {
+		writeJson(outgoing, http.StatusUnsupportedMediaType, adminError{"content type must be application/json"})
+		return
+	}
+
+	switch incoming.Method {
+	case http.MethodGet:
+		writeJson(outgoing, http.StatusOK, a.repro.MappingStates())
+
+	case http.MethodPost:
+		a.addMapping(outgoing, incoming)
+
+	case http.MethodDelete:
+		a.removeMapping(outgoing, incoming)
+
+	default:
+		outgoing.Header().Set("allow", "GET, POST, DELETE")
+		writeJson(outgoing, http.StatusMethodNotAllowed, adminError{"method not allowed"})
+	}
+}
+
+func (a *adminApi) addMapping(outgoing http.ResponseWriter, incoming *http.Request) {
+	var request struct {
+		Local  string `json:"local"`
+		Remote string `json:"remote"`
+	}
+
+	if err := json.NewDecoder(incoming.Body).Decode(&request); err != nil {
+		writeJson(outgoing, http.StatusBadRequest, adminError{err.Error()})
+		return
+	}
+
+	if _, err := NewMapping(request.Local, request.Remote); err != nil {
+		writeJson(outgoing, http.StatusBadRequest, adminError{err.Error()})
+		return
+	}
+
+	state, err := a.repro.AddMapping(request.Local, request.Remote)
+
+	if err != nil {
+		writeJson(outgoing, http.StatusConflict, adminError{err.Error()})
+		return
+	}
+
+	writeJson(outgoing, http.StatusCreated, state)
+}
+
+func (a *adminApi) removeMapping(outgoing http.ResponseWriter, incoming *http.Request) {
+	query := incoming.URL.Query()
+
+	if query.Get("local") == "" {
+		writeJson(outgoing, http.StatusBadRequest, adminError{"the local address is required"})
+		return
+	}
+
+	if err := a.repro.RemoveMapping(query.Get("local"), query.Get("remote")); err != nil {
+		writeJson(outgoing, http.StatusNotFound, adminError{err.Error()})
+		return
+	}
+
+	outgoing.WriteHeader(http.StatusNoContent)
+}
+
+// Host names other than localhost are rejected against DNS rebinding
+func (a *adminApi) allowsHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	bound, _, _ := net.SplitHostPort(a.server.Addr)
+	boundIp := net.ParseIP(bound)
+
+	if strings.EqualFold(host, "localhost") {
+		return boundIp == nil || boundIp.IsLoopback() || boundIp.IsUnspecified()
+	}
+
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+
+	if ip == nil {
+		return false
+	}
+
+	return boundIp == nil || boundIp.IsUnspecified() || ip.Equal(boundIp)
+}
+
+func isJsonContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	return err == nil && mediaType == "application/json"
+}
+
+func writeJson(outgoing http.ResponseWriter, status int, value interface{}) {
+	outgoing.Header().Set("content-type", "application/json")
+	outgoing.Header().Set("cache-control", "no-store")
+	outgoing.WriteHeader(status)
+
+	json.NewEncoder(outgoing).Encode(value)
+}
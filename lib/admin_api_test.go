@@ -0,0 +1,204 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminApi(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html")
+		fmt.Fprint(w, `<a href="http://added.test/"></a>`)
+	}))
+	defer upstream.Close()
+
+	proxy := httptest.NewUnstartedServer(nil)
+
+	cfg := NewConfig()
+	cfg.SetLog(ioutil.Discard)
+	cfg.AddRewriteRoute(".")
+	cfg.AddMapping(proxy.Listener.Addr().String(), upstream.URL)
+	cfg.SetAdminAddress("0")
+
+	r, err := NewRepro(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.Config.Handler = r.proxies[0]
+	proxy.Start()
+	defer proxy.Close()
+
+	admin := httptest.NewServer(r.admin)
+	defer admin.Close()
+
+	local := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+
+	response, err := http.Post(admin.URL+"/mappings", "application/json",
+		strings.NewReader(fmt.Sprintf(`{"local":"%s","remote":"http://added.test"}`, local)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status %d", response.StatusCode)
+	}
+
+	// Running proxies know the new mapping
+	response, err = http.Get(proxy.URL + "/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	if string(body) != fmt.Sprintf(`<a href="http://%s/"></a>`, local) {
+		t.Fatalf("unexpected body %s", body)
+	}
+
+	response, err = http.Post(admin.URL+"/mappings", "application/json",
+		strings.NewReader(fmt.Sprintf(`{"local":"%s","remote":"http://other.test"}`, local)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusConflict {
+		t.Fatalf("expected a conflict, got %d", response.StatusCode)
+	}
+
+	response, err = http.Post(admin.URL+"/mappings", "application/json",
+		strings.NewReader(fmt.Sprintf(`{"local":"https://127.0.0.1:%d","remote":"http://secure.test"}`, freePort(t))))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusConflict {
+		t.Fatalf("https mapping without CA should be rejected, got %d", response.StatusCode)
+	}
+
+	states := adminMappings(t, admin.URL)
+
+	if len(states) != 2 || states[1].Local != local || states[1].State != proxyRunning {
+		t.Fatalf("unexpected mappings %v", states)
+	}
+
+	request, _ := http.NewRequest(http.MethodDelete, admin.URL+"/mappings?local="+local, nil)
+	request.Header.Set("content-type", "application/json")
+	response, err = http.DefaultClient.Do(request)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", response.StatusCode)
+	}
+
+	if states = adminMappings(t, admin.URL); len(states) != 1 {
+		t.Fatalf("expected the mapping to be removed, got %v", states)
+	}
+
+	if len(r.registry.Mappings()) != 1 {
+		t.Fatal("mapping was not removed from the registry")
+	}
+
+	if _, err = http.Get("http://" + local + "/"); err == nil {
+		t.Fatal("listener should be closed")
+	}
+
+	response, err = http.DefaultClient.Do(request)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected an unknown mapping, got %d", response.StatusCode)
+	}
+}
+
+func TestAdminApiRejectsCrossSiteRequests(t *testing.T) {
+	cfg := NewConfig()
+	cfg.SetLog(ioutil.Discard)
+	cfg.SetAdminAddress("0")
+
+	r, err := NewRepro(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := httptest.NewServer(r.admin)
+	defer admin.Close()
+
+	body := fmt.Sprintf(`{"local":"127.0.0.1:%d","remote":"http://internal.test"}`, freePort(t))
+
+	response, err := http.Post(admin.URL+"/mappings", "text/plain", strings.NewReader(body))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("text/plain body should be rejected, got %d", response.StatusCode)
+	}
+
+	request, _ := http.NewRequest(http.MethodPost, admin.URL+"/mappings", strings.NewReader(body))
+	request.Header.Set("content-type", "application/json")
+	request.Host = "attacker.example.com"
+
+	response, err = http.DefaultClient.Do(request)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusForbidden {
+		t.Fatalf("foreign host should be rejected, got %d", response.StatusCode)
+	}
+
+	if len(r.MappingStates()) != 0 {
+		t.Fatal("no mapping should have been added")
+	}
+}
+
+func adminMappings(t *testing.T, url string) (states []MappingState) {
+	response, err := http.Get(url + "/mappings")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer response.Body.Close()
+
+	if err = json.NewDecoder(response.Body).Decode(&states); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
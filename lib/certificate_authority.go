@@ -0,0 +1,289 @@
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	caCertificateFile = "ca.pem"
+	caKeyFile         = "ca-key.pem"
+
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 365 * 24 * time.Hour
+)
+
+type CertificateAuthority struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	leafs       map[string]*tls.Certificate
+	mutex       sync.Mutex
+}
+
+func (ca *CertificateAuthority) CertificatePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: ca.certificate.Raw,
+	})
+}
+
+func (ca *CertificateAuthority) CertificateDER() []byte {
+	return ca.certificate.Raw
+}
+
+func (ca *CertificateAuthority) GetCertificate(hello *tls.ClientHelloInfo) (cert *tls.Certificate, err error) {
+	// Clients do not send SNI when connecting via IP, so the server name is
+	// empty in this case and we issue a certificate for all local IPs.
+	name := hello.ServerName
+
+	var localIP net.IP
+	if hello.Conn != nil {
+		if addr, ok := hello.Conn.LocalAddr().(*net.TCPAddr); ok {
+			localIP = addr.IP
+		}
+	}
+
+	key := name
+	if localIP != nil {
+		key += "|" + localIP.String()
+	}
+
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	if cert = ca.leafs[key]; cert != nil && time.Now().Before(cert.Leaf.NotAfter) {
+		return
+	}
+
+	cert, err = ca.issueLeaf(name, localIP)
+
+	if err == nil {
+		ca.leafs[key] = cert
+	}
+
+	return
+}
+
+func (ca *CertificateAuthority) issueLeaf(name string, localIP net.IP) (cert *tls.Certificate, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return
+	}
+
+	serial, err := randomSerial()
+
+	if err != nil {
+		return
+	}
+
+	commonName := name
+	if commonName == "" {
+		commonName = "go-repro"
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"go-repro"},
+			CommonName:   commonName,
+		},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(leafValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: localIPs(),
+	}
+
+	if localIP != nil && !localIP.IsUnspecified() {
+		template.IPAddresses = appendIP(template.IPAddresses, localIP)
+	}
+
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = appendIP(template.IPAddresses, ip)
+	} else if name != "" && name != "localhost" {
+		template.DNSNames = append(template.DNSNames, name)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+
+	if err != nil {
+		return
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+
+	if err != nil {
+		return
+	}
+
+	cert = &tls.Certificate{
+		Certificate: [][]byte{der, ca.certificate.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+
+	return
+}
+
+func localIPs() (ips []net.IP) {
+	ips = []net.IP{
+		net.ParseIP("127.0.0.1"),
+		net.ParseIP("::1"),
+		// The android emulator reaches the host via this address
+		net.ParseIP("10.0.2.2"),
+	}
+
+	addrs, err := net.InterfaceAddrs()
+
+	if err != nil {
+		return
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = appendIP(ips, ipNet.IP)
+		}
+	}
+
+	return
+}
+
+func appendIP(ips []net.IP, ip net.IP) []net.IP {
+	for _, existing := range ips {
+		if existing.Equal(ip) {
+			return ips
+		}
+	}
+
+	return append(ips, ip)
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func createCertificateAuthority(certFile, keyFile string) (err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return
+	}
+
+	serial, err := randomSerial()
+
+	if err != nil {
+		return
+	}
+
+	hostname, _ := os.Hostname()
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"go-repro"},
+			CommonName:   fmt.Sprintf("go-repro development CA (%s)", hostname),
+		},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		return
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		return
+	}
+
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	if err == nil {
+		err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	}
+
+	return
+}
+
+func loadCertificateAuthority(certFile, keyFile string) (ca *CertificateAuthority, err error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+
+	if err != nil {
+		return
+	}
+
+	certificate, err := x509.ParseCertificate(pair.Certificate[0])
+
+	if err != nil {
+		return
+	}
+
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+
+	if !ok || !certificate.IsCA {
+		err = errors.New(fmt.Sprintf("%s: not a go-repro CA", certFile))
+		return
+	}
+
+	ca = &CertificateAuthority{
+		certificate: certificate,
+		key:         key,
+		leafs:       make(map[string]*tls.Certificate),
+	}
+
+	return
+}
+
+func DefaultCADir() string {
+	dir, err := os.UserConfigDir()
+
+	if err != nil {
+		dir = os.TempDir()
+	}
+
+	return filepath.Join(dir, "go-repro")
+}
+
+func LoadOrCreateCertificateAuthority(dir string) (ca *CertificateAuthority, err error) {
+	certFile := filepath.Join(dir, caCertificateFile)
+	keyFile := filepath.Join(dir, caKeyFile)
+
+	if _, e := os.Stat(certFile); os.IsNotExist(e) {
+		err = os.MkdirAll(dir, 0700)
+
+		if err == nil {
+			err = createCertificateAuthority(certFile, keyFile)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	ca, err = loadCertificateAuthority(certFile, keyFile)
+
+	return
+}
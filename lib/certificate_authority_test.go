@@ -0,0 +1,55 @@
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCertificateAuthority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-repro-ca")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	ca, err := LoadOrCreateCertificateAuthority(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := LoadOrCreateCertificateAuthority(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(reloaded.CertificateDER()) != string(ca.CertificateDER()) {
+		t.Fatal("CA should be persisted and reused")
+	}
+
+	cert, err := ca.GetCertificate(&tls.ClientHelloInfo{ServerName: "foo.local"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.CertificatePEM())
+
+	for _, name := range []string{"foo.local", "127.0.0.1", "10.0.2.2"} {
+		_, err = cert.Leaf.Verify(x509.VerifyOptions{
+			DNSName: name,
+			Roots:   roots,
+		})
+
+		if err != nil {
+			t.Fatalf("leaf certificate does not verify for %s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+const charsetPrescanLength = 1024
+
+var cssCharsetPattern = regexp.MustCompile(`^@charset "([^"]*)";`)
+
+type bodyCharset struct {
+	name     string
+	encoding encoding.Encoding
+	bom      []byte
+	html     bool
+}
+
+var boms = []struct {
+	bom      []byte
+	encoding encoding.Encoding
+	name     string
+}{
+	{[]byte{0xef, 0xbb, 0xbf}, unicode.UTF8, "utf-8"},
+	{[]byte{0xfe, 0xff}, unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), "utf-16be"},
+	{[]byte{0xff, 0xfe}, unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), "utf-16le"},
+}
+
+// Charset by BOM, header or document, nil for UTF-8 and unknown charsets
+func detectBodyCharset(body []byte, contentType string) (c *bodyCharset) {
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	isHtml := mediaType == "text/html" || mediaType == "application/xhtml+xml"
+
+	for _, candidate := range boms {
+		if bytes.HasPrefix(body, candidate.bom) {
+			c = &bodyCharset{
+				name:     candidate.name,
+				encoding: candidate.encoding,
+				bom:      candidate.bom,
+			}
+
+			break
+		}
+	}
+
+	if c == nil {
+		label := params["charset"]
+
+		if label == "" && isHtml {
+			label = prescanHtmlCharset(body)
+		}
+
+		if label == "" && mediaType == "text/css" {
+			if match := cssCharsetPattern.FindSubmatch(body); match != nil {
+				label = string(match[1])
+			}
+		}
+
+		if label == "" {
+			return
+		}
+
+		e, name := charset.Lookup(label)
+
+		if e == nil {
+			return
+		}
+
+		c = &bodyCharset{
+			name:     name,
+			encoding: e,
+		}
+	}
+
+	if c.name == "utf-8" {
+		return nil
+	}
+
+	c.html = isHtml
+
+	return
+}
+
+func hasCharsetParameter(contentType string) bool {
+	_, params, _ := mime.ParseMediaType(contentType)
+
+	return params["charset"] != ""
+}
+
+func prescanHtmlCharset(body []byte) string {
+	if len(body) > charsetPrescanLength {
+		body = body[:charsetPrescanLength]
+	}
+
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return ""
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+
+			if token.Data != "meta" {
+				continue
+			}
+
+			httpEquiv, content := "", ""
+
+			for _, attribute := range token.Attr {
+				switch strings.ToLower(attribute.Key) {
+				case "charset":
+					return strings.TrimSpace(attribute.Val)
+
+				case "http-equiv":
+					httpEquiv = strings.ToLower(attribute.Val)
+
+				case "content":
+					content = attribute.Val
+				}
+			}
+
+			if httpEquiv == "content-type" {
+				if _, params, err := mime.ParseMediaType(content); err == nil && params["charset"] != "" {
+					return params["charset"]
+				}
+			}
+		}
+	}
+}
+
+func (c *bodyCharset) decode(body []byte) ([]byte, error) {
+	return c.encoding.NewDecoder().Bytes(body[len(c.bom):])
+}
+
+func (c *bodyCharset) encoder() *encoding.Encoder {
+	// Use character references for HTML
+	if c.html {
+		return encoding.HTMLEscapeUnsupported(c.encoding.NewEncoder())
+	}
+
+	return encoding.ReplaceUnsupported(c.encoding.NewEncoder())
+}
+
+func (c *bodyCharset) encode(text []byte) (body []byte, err error) {
+	encoded, err := c.encoder().Bytes(text)
+
+	if err == nil {
+		body = append(append([]byte(nil), c.bom...), encoded...)
+	}
+
+	return
+}
+
+func (c *bodyCharset) decodeReader(body io.Reader) io.Reader {
+	return transform.NewReader(body, c.encoding.NewDecoder())
+}
+
+func (c *bodyCharset) encodeReader(text io.Reader) io.Reader {
+	return io.MultiReader(bytes.NewReader(c.bom), transform.NewReader(text, c.encoder()))
+}
@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func assertCharsetRewritesTo(t *testing.T, contentType string, original, expected []byte) {
+	mappings, err := newMockContext()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := newRequestContext()
+	ctx.hostMappings = mappings
+	ctx.incomingRequest = httptest.NewRequest("GET", "/", nil)
+	ctx.upstreamResponse = &http.Response{
+		Header: http.Header{"Content-Type": []string{contentType}},
+	}
+
+	p := &ProxyServer{log: ioutil.Discard}
+
+	rewritten := p.rewriteBodyData(original, []BodyRewriter{NewGenericResponseRewriter(nil)}, ctx)
+
+	if !bytes.Equal(rewritten, expected) {
+		t.Fatalf("rewrite failed, got %v, expected %v", rewritten, expected)
+	}
+}
+
+func utf16le(s string) []byte {
+	result := []byte{0xff, 0xfe}
+
+	for _, c := range s {
+		result = append(result, byte(c), 0)
+	}
+
+	return result
+}
+
+func TestCharsetLatin1(t *testing.T) {
+	assertCharsetRewritesTo(t, "text/plain; charset=ISO-8859-1",
+		[]byte("caf\xe9 http://foo.bar/x"),
+		[]byte("caf\xe9 http://1.2.3.4:8888/x"))
+}
+
+func TestCharsetUTF16BOM(t *testing.T) {
+	assertCharsetRewritesTo(t, "text/plain",
+		utf16le("see http://foo.bar/"),
+		utf16le("see http://1.2.3.4:8888/"))
+}
+
+func TestCharsetShiftJIS(t *testing.T) {
+	// 0x83 0x5c is a katakana character ending in a backslash
+	assertCharsetRewritesTo(t, "text/plain; charset=shift_jis",
+		[]byte("\x83\x5chttp://foo.bar"),
+		[]byte("\x83\x5chttp://1.2.3.4:8888"))
+}
+
+func TestCharsetUnchanged(t *testing.T) {
+	original := []byte("caf\xe9 http://bar.foo/")
+
+	assertCharsetRewritesTo(t, "text/plain; charset=iso-8859-1", original, original)
+}
+
+func TestCharsetDetection(t *testing.T) {
+	if c := detectBodyCharset([]byte(`<html><head><meta charset="iso-8859-15">`), "text/html"); c == nil || c.name != "iso-8859-15" {
+		t.Fatalf("meta charset not detected: %v", c)
+	}
+
+	if c := detectBodyCharset([]byte(`<meta http-equiv="Content-Type" content="text/html; charset=windows-1251">`), "text/html"); c == nil || c.name != "windows-1251" {
+		t.Fatalf("meta http-equiv charset not detected: %v", c)
+	}
+
+	if c := detectBodyCharset([]byte(`@charset "koi8-r"; a {}`), "text/css"); c == nil || c.name != "koi8-r" {
+		t.Fatalf("css charset not detected: %v", c)
+	}
+
+	if c := detectBodyCharset([]byte(`<meta charset="utf-8">`), "text/html; charset=utf-8"); c != nil {
+		t.Fatalf("UTF-8 should not be transcoded: %v", c)
+	}
+}
@@ -0,0 +1,187 @@
+package lib
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported content codings in order of preference
+var supportedEncodings = []string{"br", "zstd", "gzip", "deflate"}
+
+var upstreamAcceptEncoding = strings.Join(supportedEncodings, ", ")
+
+type acceptedEncodings map[string]float64
+
+type compressingWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func isSupportedEncoding(encoding string) bool {
+	for _, supported := range supportedEncodings {
+		if encoding == supported {
+			return true
+		}
+	}
+
+	return false
+}
+
+func normalizeEncoding(encoding string) string {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+
+	// Legacy aliases
+	if encoding == "x-gzip" {
+		encoding = "gzip"
+	}
+
+	return encoding
+}
+
+func parseAcceptEncoding(header string) (accepted acceptedEncodings) {
+	accepted = make(acceptedEncodings)
+
+	for _, element := range strings.Split(header, ",") {
+		params := strings.Split(element, ";")
+		encoding := normalizeEncoding(params[0])
+
+		if encoding == "" {
+			continue
+		}
+
+		q := 1.0
+
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+
+			if len(param) > 2 && strings.ToLower(param[:2]) == "q=" {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+
+		accepted[encoding] = q
+	}
+
+	return
+}
+
+func (a acceptedEncodings) quality(encoding string) float64 {
+	if q, ok := a[encoding]; ok {
+		return q
+	}
+
+	if q, ok := a["*"]; ok {
+		return q
+	}
+
+	// Identity is always acceptable unless explicitly excluded
+	if encoding == "identity" {
+		return 1
+	}
+
+	return 0
+}
+
+func (a acceptedEncodings) accepts(encoding string) bool {
+	return a.quality(encoding) > 0
+}
+
+// The accepted encoding with the highest q-value, empty for no compression
+func (a acceptedEncodings) negotiate(preferred string) (encoding string) {
+	best := 0.0
+
+	candidates := supportedEncodings
+	if isSupportedEncoding(preferred) {
+		candidates = append([]string{preferred}, supportedEncodings...)
+	}
+
+	for _, candidate := range candidates {
+		if q := a.quality(candidate); q > best {
+			best = q
+			encoding = candidate
+		}
+	}
+
+	return
+}
+
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func (r zstdReader) Close() error {
+	r.Decoder.Close()
+
+	return nil
+}
+
+// Decoders must be closed, zstd holds goroutines and buffers
+func newDecodingReader(encoding string, reader io.Reader) (decoded io.ReadCloser, err error) {
+	switch encoding {
+	case "gzip":
+		decoded, err = gzip.NewReader(reader)
+
+	case "deflate":
+		// Many servers send raw deflate instead of zlib data
+		buffered := bufio.NewReader(reader)
+		header, e := buffered.Peek(2)
+
+		if e == nil && header[0]&0x0f == 8 && (uint(header[0])<<8|uint(header[1]))%31 == 0 {
+			decoded, err = zlib.NewReader(buffered)
+		} else {
+			decoded = flate.NewReader(buffered)
+		}
+
+	case "br":
+		decoded = ioutil.NopCloser(brotli.NewReader(reader))
+
+	case "zstd":
+		var decoder *zstd.Decoder
+
+		// Synchronous decoding
+		decoder, err = zstd.NewReader(reader, zstd.WithDecoderConcurrency(1))
+
+		if err == nil {
+			decoded = zstdReader{decoder}
+		}
+
+	default:
+		err = errors.New(fmt.Sprintf("unsupported content encoding %s", encoding))
+	}
+
+	return
+}
+
+func newEncodingWriter(encoding string, writer io.Writer) (encoded compressingWriter, err error) {
+	switch encoding {
+	case "gzip":
+		encoded = gzip.NewWriter(writer)
+
+	case "deflate":
+		encoded = zlib.NewWriter(writer)
+
+	case "br":
+		encoded = brotli.NewWriter(writer)
+
+	case "zstd":
+		encoded, err = zstd.NewWriter(writer)
+
+	default:
+		err = errors.New(fmt.Sprintf("unsupported content encoding %s", encoding))
+	}
+
+	return
+}
@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptEncodingQValues(t *testing.T) {
+	accepted := parseAcceptEncoding("gzip;q=0, deflate; q=0.5, br;q=0.8")
+
+	if accepted.accepts("gzip") {
+		t.Fatal("q=0 should exclude gzip")
+	}
+
+	if !accepted.accepts("deflate") || !accepted.accepts("identity") || accepted.accepts("zstd") {
+		t.Fatalf("wrong acceptance: %v", accepted)
+	}
+
+	if encoding := accepted.negotiate("gzip"); encoding != "br" {
+		t.Fatalf("expected br, got %s", encoding)
+	}
+}
+
+func TestAcceptEncodingWildcard(t *testing.T) {
+	accepted := parseAcceptEncoding("*;q=0.5, zstd;q=0")
+
+	if accepted.accepts("zstd") || !accepted.accepts("gzip") {
+		t.Fatalf("wrong wildcard handling: %v", accepted)
+	}
+
+	// The upstream encoding is preferred on ties
+	if encoding := accepted.negotiate("deflate"); encoding != "deflate" {
+		t.Fatalf("expected deflate, got %s", encoding)
+	}
+
+	if encoding := parseAcceptEncoding("").negotiate("gzip"); encoding != "" {
+		t.Fatalf("no compression expected, got %s", encoding)
+	}
+
+	if encoding := parseAcceptEncoding("x-gzip").negotiate("br"); encoding != "gzip" {
+		t.Fatalf("expected gzip, got %s", encoding)
+	}
+}
+
+func TestCompressionRoundtrip(t *testing.T) {
+	data := bytes.Repeat([]byte("http://foo.bar/ "), 1000)
+
+	for _, encoding := range supportedEncodings {
+		var buffer bytes.Buffer
+
+		writer, err := newEncodingWriter(encoding, &buffer)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		writer.Write(data)
+		writer.Close()
+
+		reader, err := newDecodingReader(encoding, &buffer)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := ioutil.ReadAll(reader)
+
+		if err != nil || !bytes.Equal(decoded, data) {
+			t.Fatalf("%s roundtrip failed: %v", encoding, err)
+		}
+
+		if err = reader.Close(); err != nil {
+			t.Fatalf("closing the %s decoder failed: %v", encoding, err)
+		}
+	}
+}
+
+func TestRawDeflate(t *testing.T) {
+	var buffer bytes.Buffer
+
+	writer, _ := flate.NewWriter(&buffer, flate.DefaultCompression)
+	writer.Write([]byte("raw deflate"))
+	writer.Close()
+
+	reader, err := newDecodingReader("deflate", &buffer)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := ioutil.ReadAll(reader)
+
+	if err != nil || string(decoded) != "raw deflate" {
+		t.Fatalf("raw deflate not decoded: %v", err)
+	}
+}
+
+func TestRecompressRewrittenResponse(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/plain")
+		w.Header().Set("content-encoding", "br")
+
+		writer, _ := newEncodingWriter("br", w)
+		writer.Write([]byte("see http://foo.bar/baz"))
+		writer.Close()
+	}))
+	defer upstream.Close()
+
+	local, _ := NewMapping("127.0.0.1:8080", upstream.URL)
+	foo, _ := NewMapping("127.0.0.1:8081", "http://foo.bar")
+
+	p, err := NewProxyServer(local, []Mapping{local, foo}, ioutil.Discard, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := NewConfig()
+	config.AddRewriteRoute(".")
+	p.AddRewriter(NewGenericResponseRewriter(config.rewriteRoutes))
+
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Host = "127.0.0.1:8080"
+	request.Header.Set("accept-encoding", "br;q=0, gzip")
+
+	response := httptest.NewRecorder()
+	p.ServeHTTP(response, request)
+
+	if encoding := response.Header().Get("content-encoding"); encoding != "gzip" {
+		t.Fatalf("expected gzip encoding, got %s", encoding)
+	}
+
+	reader, err := newDecodingReader("gzip", response.Body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(reader)
+
+	if err != nil || string(body) != "see http://127.0.0.1:8081/baz" {
+		t.Fatalf("body not rewritten: %s (%v)", body, err)
+	}
+}
@@ -1,22 +1,49 @@
 package lib
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"regexp"
+	"strings"
+	"time"
 )
 
 type Config struct {
-	mappings         []Mapping
-	rewriteRoutes    []*regexp.Regexp
-	log              io.Writer
-	sslAllowInsecure bool
-	noLogging        bool
+	mappings          []Mapping
+	rewriteRoutes     []*regexp.Regexp
+	log               io.Writer
+	sslAllowInsecure  bool
+	noLogging         bool
+	caDir             string
+	onboarding        bool
+	rewriteWebsockets bool
+	scopeCookieDomain bool
+	stripHsts         bool
+	virtualHosting    string
+	wildcardMappings  []WildcardMapping
+	adminAddress      string
+	drainTimeout      time.Duration
+
+	recordingDir     string
+	recordingMaxSize int64
+
+	discovery          bool
+	discoveryAllowlist []string
+	discoveryPorts     *portRange
+
+	rewriteHeaders         []string
+	rewriteIncomingHeaders []string
+
+	rules []RewriteRule
 }
 
 func NewConfig() Config {
 	return Config{
-		log: os.Stdout,
+		log:          os.Stdout,
+		caDir:        DefaultCADir(),
+		drainTimeout: DefaultDrainTimeout,
 	}
 }
 
@@ -30,6 +57,95 @@ func (c *Config) AddMapping(local, remote string) (err error) {
 	return
 }
 
+func (c *Config) AddWildcardMapping(local, remote string) (err error) {
+	w, err := NewWildcardMapping(local, remote)
+
+	if err == nil {
+		c.wildcardMappings = append(c.wildcardMappings, w)
+	}
+
+	return
+}
+
+func (c *Config) CountWildcardMappings() int {
+	return len(c.wildcardMappings)
+}
+
+func (c *Config) AdminAddress() string {
+	return c.adminAddress
+}
+
+// The address of the admin API. It binds to localhost unless an IP is given.
+func (c *Config) SetAdminAddress(address string) {
+	if address != "" && !strings.Contains(address, ":") {
+		address = ":" + address
+	}
+
+	if strings.HasPrefix(address, ":") {
+		address = "127.0.0.1" + address
+	}
+
+	c.adminAddress = address
+}
+
+func (c *Config) DrainTimeout() time.Duration {
+	return c.drainTimeout
+}
+
+// How long active requests may take to complete when a proxy is shut down
+func (c *Config) SetDrainTimeout(timeout time.Duration) {
+	c.drainTimeout = timeout
+}
+
+func (c *Config) Recording() string {
+	return c.recordingDir
+}
+
+// Records all exchanges as HAR files in the directory
+func (c *Config) SetRecording(dir string) {
+	c.recordingDir = dir
+}
+
+func (c *Config) RecordingMaxSize() int64 {
+	return c.recordingMaxSize
+}
+
+// Starts a new HAR file once the current one exceeds the size in bytes
+func (c *Config) SetRecordingMaxSize(size int64) {
+	c.recordingMaxSize = size
+}
+
+func (c *Config) Discovery() bool {
+	return c.discovery
+}
+
+// Collects unmapped hosts that are referenced by responses
+func (c *Config) SetDiscovery(flag bool) {
+	c.discovery = flag
+}
+
+// Discovered hosts matching the pattern are mapped while running
+func (c *Config) AddDiscoveryHost(pattern string) (err error) {
+	err = validateDiscoveryPattern(pattern)
+
+	if err == nil {
+		c.discoveryAllowlist = append(c.discoveryAllowlist, pattern)
+	}
+
+	return
+}
+
+// The ports for mappings of discovered hosts, e.g. 0.0.0.0:9100-9199
+func (c *Config) SetDiscoveryPorts(local string) (err error) {
+	ports, err := parsePortRange(local)
+
+	if err == nil {
+		c.discoveryPorts = &ports
+	}
+
+	return
+}
+
 func (c *Config) AddRewriteRoute(pattern string) (err error) {
 	r, err := regexp.Compile(pattern)
 
@@ -40,6 +156,36 @@ func (c *Config) AddRewriteRoute(pattern string) (err error) {
 	return
 }
 
+func (c *Config) AddRewriteHeader(header string) {
+	c.rewriteHeaders = append(c.rewriteHeaders, strings.ToLower(header))
+}
+
+func (c *Config) AddRewriteIncomingHeader(header string) {
+	c.rewriteIncomingHeaders = append(c.rewriteIncomingHeaders, strings.ToLower(header))
+}
+
+func (c *Config) RewriteHeaders() []string {
+	return c.rewriteHeaders
+}
+
+func (c *Config) RewriteIncomingHeaders() []string {
+	return c.rewriteIncomingHeaders
+}
+
+func (c *Config) AddRule(name, route, contentType, target, pattern, replacement string) (err error) {
+	r, err := NewRewriteRule(name, route, contentType, target, pattern, replacement)
+
+	if err == nil {
+		c.rules = append(c.rules, r)
+	}
+
+	return
+}
+
+func (c *Config) CountRules() int {
+	return len(c.rules)
+}
+
 func (c *Config) SetLog(log io.Writer) {
 	c.log = log
 }
@@ -67,3 +213,82 @@ func (c *Config) NoLogging() bool {
 func (c *Config) SetNoLogging(flag bool) {
 	c.noLogging = flag
 }
+
+func (c *Config) CADir() string {
+	return c.caDir
+}
+
+func (c *Config) SetCADir(dir string) {
+	c.caDir = dir
+}
+
+func (c *Config) Onboarding() bool {
+	return c.onboarding
+}
+
+func (c *Config) SetOnboarding(flag bool) {
+	c.onboarding = flag
+}
+
+func (c *Config) RewriteWebsockets() bool {
+	return c.rewriteWebsockets
+}
+
+func (c *Config) SetRewriteWebsockets(flag bool) {
+	c.rewriteWebsockets = flag
+}
+
+func (c *Config) ScopeCookieDomain() bool {
+	return c.scopeCookieDomain
+}
+
+func (c *Config) SetScopeCookieDomain(flag bool) {
+	c.scopeCookieDomain = flag
+}
+
+func (c *Config) StripHsts() bool {
+	return c.stripHsts
+}
+
+func (c *Config) SetStripHsts(flag bool) {
+	c.stripHsts = flag
+}
+
+func (c *Config) VirtualHosting() string {
+	return c.virtualHosting
+}
+
+// Mappings sharing a local address are distinguished by path, host header or
+// nip.io host name
+func (c *Config) SetVirtualHosting(mode string) (err error) {
+	mode = strings.ToLower(mode)
+
+	if mode != "" && !isVirtualHostMode(mode) {
+		err = errors.New(fmt.Sprintf("unknown virtual hosting mode: %s", mode))
+		return
+	}
+
+	c.virtualHosting = mode
+
+	return
+}
+
+func (c *Config) usesLocalTLS() bool {
+	for _, m := range c.mappings {
+		if m.localTLS {
+			return true
+		}
+	}
+
+	for _, w := range c.wildcardMappings {
+		if w.ports.localTLS {
+			return true
+		}
+	}
+
+	if c.discoveryPorts != nil && c.discoveryPorts.localTLS {
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,194 @@
+package lib
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Browsers only accept cookies with these prefixes over https, so they are
+// renamed when the local side is plain http
+const (
+	secureCookiePrefix      = "__Secure-"
+	hostCookiePrefix        = "__Host-"
+	localSecureCookiePrefix = "__repro-secure-"
+	localHostCookiePrefix   = "__repro-host-"
+)
+
+type CookieRewriter struct {
+	scopeDomain bool
+}
+
+func (r *CookieRewriter) RewriteHeaders(headers http.Header, ctx RequestContext) {
+	cookies := headers["Set-Cookie"]
+
+	if len(cookies) == 0 {
+		return
+	}
+
+	rewritten := false
+	secure := strings.HasPrefix(ctx.RequestUrl(), "https://")
+
+	for i, cookie := range cookies {
+		if value := r.rewriteSetCookie(cookie, secure, ctx); value != cookie {
+			cookies[i] = value
+			rewritten = true
+		}
+	}
+
+	if rewritten {
+		ctx.Log("cookie rewriter: rewrote set-cookie")
+	}
+}
+
+func (r *CookieRewriter) rewriteSetCookie(cookie string, secure bool, ctx RequestContext) string {
+	parts := strings.Split(cookie, ";")
+	name := strings.TrimSpace(parts[0])
+
+	if !secure {
+		if strings.HasPrefix(name, secureCookiePrefix) {
+			name = localSecureCookiePrefix + name[len(secureCookiePrefix):]
+		} else if strings.HasPrefix(name, hostCookiePrefix) {
+			name = localHostCookiePrefix + name[len(hostCookiePrefix):]
+		}
+	}
+
+	attributes := []string{name}
+
+	for _, attribute := range parts[1:] {
+		attribute = strings.TrimSpace(attribute)
+		key, value := attribute, ""
+
+		if i := strings.Index(attribute, "="); i >= 0 {
+			key, value = strings.TrimSpace(attribute[:i]), strings.TrimSpace(attribute[i+1:])
+		}
+
+		switch strings.ToLower(key) {
+		case "":
+			continue
+
+		case "domain":
+			// The remote domain is of no use for the client
+			continue
+
+		case "path":
+			// Path prefixes of the remote and of virtual hosts
+			if path, ok := rewriteRootRelativeUrl(value, ctx); ok {
+				attribute = "Path=" + path
+			}
+
+		case "secure", "partitioned":
+			// Both are rejected on plain http
+			if !secure {
+				continue
+			}
+
+		case "samesite":
+			// SameSite=None requires Secure, all mapped hosts share the local
+			// site anyway
+			if !secure && strings.EqualFold(value, "none") {
+				attribute = "SameSite=Lax"
+			}
+		}
+
+		attributes = append(attributes, attribute)
+	}
+
+	if r.scopeDomain && !strings.HasPrefix(name, hostCookiePrefix) {
+		if domain := localCookieDomain(ctx); domain != "" {
+			attributes = append(attributes, "Domain="+domain)
+		}
+	}
+
+	rewritten := strings.Join(attributes, "; ")
+
+	// Keep the original formatting if nothing changed
+	if normalizeCookie(cookie) == rewritten {
+		return cookie
+	}
+
+	return rewritten
+}
+
+func normalizeCookie(cookie string) string {
+	parts := strings.Split(cookie, ";")
+	normalized := make([]string, 0, len(parts))
+
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			normalized = append(normalized, part)
+		}
+	}
+
+	return strings.Join(normalized, "; ")
+}
+
+// The remote domain is of no use for the client, so it is removed regardless of
+// the enabled rewriters
+func stripCookieDomain(cookie string) string {
+	parts := strings.Split(cookie, ";")
+	attributes := parts[:1:1]
+
+	for _, attribute := range parts[1:] {
+		key := attribute
+
+		if i := strings.Index(attribute, "="); i >= 0 {
+			key = attribute[:i]
+		}
+
+		if !strings.EqualFold(strings.TrimSpace(key), "domain") {
+			attributes = append(attributes, attribute)
+		}
+	}
+
+	return strings.Join(attributes, ";")
+}
+
+// Domain cookies are not allowed for IP addresses
+func localCookieDomain(ctx RequestContext) string {
+	host := ctx.IncomingRequest().Host
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if net.ParseIP(host) != nil || !strings.Contains(host, ".") {
+		return ""
+	}
+
+	return strings.ToLower(host)
+}
+
+func (r *CookieRewriter) RewriteIncomingHeaders(headers http.Header, ctx RequestContext) {
+	cookies := headers["Cookie"]
+	rewritten := false
+
+	for i, header := range cookies {
+		pairs := strings.Split(header, ";")
+
+		for j, pair := range pairs {
+			trimmed := strings.TrimSpace(pair)
+			leading := pair[:len(pair)-len(strings.TrimLeft(pair, " "))]
+
+			if strings.HasPrefix(trimmed, localSecureCookiePrefix) {
+				pairs[j] = leading + secureCookiePrefix + trimmed[len(localSecureCookiePrefix):]
+				rewritten = true
+			} else if strings.HasPrefix(trimmed, localHostCookiePrefix) {
+				pairs[j] = leading + hostCookiePrefix + trimmed[len(localHostCookiePrefix):]
+				rewritten = true
+			}
+		}
+
+		cookies[i] = strings.Join(pairs, ";")
+	}
+
+	if rewritten {
+		ctx.Log("cookie rewriter: rewrote cookie")
+	}
+}
+
+func NewCookieRewriter(scopeDomain bool) *CookieRewriter {
+	return &CookieRewriter{
+		scopeDomain: scopeDomain,
+	}
+}
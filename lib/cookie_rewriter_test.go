@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newCookieContext(host string, secure bool) *requestContext {
+	ctx := newRequestContext()
+	ctx.incomingRequest = httptest.NewRequest("GET", "/", nil)
+	ctx.incomingRequest.Host = host
+
+	if secure {
+		ctx.incomingRequest.TLS = &tls.ConnectionState{}
+	}
+
+	return ctx
+}
+
+func assertSetCookieRewritesTo(t *testing.T, rewriter *CookieRewriter, ctx RequestContext, original, expected string) {
+	headers := http.Header{}
+	headers.Add("set-cookie", original)
+
+	rewriter.RewriteHeaders(headers, ctx)
+
+	if rewritten := headers.Get("set-cookie"); rewritten != expected {
+		t.Fatalf("rewrite of %s failed, got %s, expected %s", original, rewritten, expected)
+	}
+}
+
+func TestSetCookieOverHttp(t *testing.T) {
+	ctx := newCookieContext("127.0.0.1:8080", false)
+	rewriter := NewCookieRewriter(false)
+
+	assertSetCookieRewritesTo(t, rewriter, ctx,
+		"session=abc; Path=/; Domain=.foo.bar; Secure; HttpOnly; SameSite=None",
+		"session=abc; Path=/; HttpOnly; SameSite=Lax")
+
+	assertSetCookieRewritesTo(t, rewriter, ctx,
+		"__Host-id=1; Path=/; Secure",
+		"__repro-host-id=1; Path=/")
+
+	assertSetCookieRewritesTo(t, rewriter, ctx,
+		"__Secure-id=1; Secure; Partitioned",
+		"__repro-secure-id=1")
+
+	assertSetCookieRewritesTo(t, rewriter, ctx, "plain=1;path=/", "plain=1;path=/")
+}
+
+func TestSetCookieOverHttps(t *testing.T) {
+	ctx := newCookieContext("127.0.0.1:8443", true)
+
+	assertSetCookieRewritesTo(t, NewCookieRewriter(false), ctx,
+		"__Host-id=1; Path=/; Secure; SameSite=None",
+		"__Host-id=1; Path=/; Secure; SameSite=None")
+
+	assertSetCookieRewritesTo(t, NewCookieRewriter(false), ctx,
+		"id=1; Domain=foo.bar; Secure",
+		"id=1; Secure")
+}
+
+func TestSetCookieDomainScoping(t *testing.T) {
+	rewriter := NewCookieRewriter(true)
+
+	assertSetCookieRewritesTo(t, rewriter, newCookieContext("dev.local:8080", false),
+		"id=1; Domain=foo.bar",
+		"id=1; Domain=dev.local")
+
+	// Not possible for IP addresses
+	assertSetCookieRewritesTo(t, rewriter, newCookieContext("127.0.0.1:8080", false),
+		"id=1; Domain=foo.bar",
+		"id=1")
+}
+
+func TestIncomingCookie(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("cookie", "a=1; __repro-secure-b=2; __repro-host-c=3")
+
+	NewCookieRewriter(false).RewriteIncomingHeaders(headers, newCookieContext("127.0.0.1:8080", false))
+
+	if cookie := headers.Get("cookie"); cookie != "a=1; __Secure-b=2; __Host-c=3" {
+		t.Fatalf("unexpected cookie header %s", cookie)
+	}
+}
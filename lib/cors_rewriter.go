@@ -8,14 +8,15 @@ type CorsRewriter struct {
 	GenericHeaderRewriter
 }
 
+// Origins never have a path, even if the remote has one
 func (c *CorsRewriter) RewriteIncomingHeaders(headers http.Header, ctx RequestContext) {
-	if c.GenericHeaderRewriter.RewriteSpecifiedIncomingHeaders([]string{"origin"}, headers, ctx) {
+	if c.GenericHeaderRewriter.rewriteSpecifiedHeaders([]string{"origin"}, headers, newLocalHostMatcher(ctx, true).withoutPaths()) {
 		ctx.Log("rewrote origin")
 	}
 }
 
 func (c *CorsRewriter) RewriteHeaders(headers http.Header, ctx RequestContext) {
-	if c.GenericHeaderRewriter.RewriteSpecifiedHeaders([]string{"access-control-allow-origin"}, headers, ctx) {
+	if c.GenericHeaderRewriter.rewriteSpecifiedHeaders([]string{"access-control-allow-origin"}, headers, newRemoteHostMatcher(ctx, true).withoutPaths()) {
 		ctx.Log("rewrote access-control-allow-origin")
 	}
 }
@@ -0,0 +1,380 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type CssRewriter struct {
+	rewriteRoutes []*regexp.Regexp
+}
+
+type cssScanner struct {
+	css       []byte
+	pos       int
+	out       bytes.Buffer
+	ctx       RequestContext
+	rewritten bool
+
+	parenDepth     int
+	imageSetDepths []int
+	importPending  bool
+}
+
+func (r *CssRewriter) Matches(ctx RequestContext) bool {
+	if responseMediaType(ctx) != "text/css" {
+		return false
+	}
+
+	return matchesRewriteRoutes(r.rewriteRoutes, ctx.RequestUrl())
+}
+
+func (r *CssRewriter) RewriteResponse(response []byte, ctx RequestContext) []byte {
+	rewritten, ok := rewriteCss(response, ctx)
+
+	if ok {
+		ctx.Log("css rewriter: response rewritten")
+	}
+
+	return rewritten
+}
+
+func rewriteCss(css []byte, ctx RequestContext) (result []byte, rewritten bool) {
+	scanner := &cssScanner{
+		css: css,
+		ctx: ctx,
+	}
+
+	scanner.scan()
+
+	if !scanner.rewritten {
+		return css, false
+	}
+
+	return scanner.out.Bytes(), true
+}
+
+func (s *cssScanner) scan() {
+	for s.pos < len(s.css) {
+		c := s.css[s.pos]
+
+		switch {
+		case c == '/' && s.peek(1) == '*':
+			end := bytes.Index(s.css[s.pos+2:], []byte("*/"))
+			if end < 0 {
+				s.copyTo(len(s.css))
+			} else {
+				s.copyTo(s.pos + 2 + end + 2)
+			}
+
+		case c == '"' || c == '\'':
+			start := s.pos
+			value := s.scanString()
+
+			if s.importPending || len(s.imageSetDepths) > 0 {
+				s.emitUrl(s.css[start:s.pos], value, c)
+			} else {
+				s.out.Write(s.css[start:s.pos])
+			}
+
+			s.importPending = false
+
+		case c == '@':
+			start := s.pos
+			s.pos++
+			name := s.scanIdent()
+			s.out.Write(s.css[start:s.pos])
+
+			s.importPending = strings.ToLower(name) == "import"
+
+		case isCssIdentStart(c) || (c == '-' && isCssIdentStart(s.peek(1))) || c == '\\':
+			start := s.pos
+			name := strings.ToLower(s.scanIdent())
+
+			if s.pos == start {
+				// Escaped newline, not part of an identifier
+				s.copyTo(s.pos + 1)
+				break
+			}
+
+			if s.peek(0) != '(' {
+				s.out.Write(s.css[start:s.pos])
+				break
+			}
+
+			switch name {
+			case "url":
+				s.pos++
+				s.scanUrl(start)
+				s.importPending = false
+
+			case "image-set", "-webkit-image-set":
+				s.out.Write(s.css[start:s.pos])
+				s.imageSetDepths = append(s.imageSetDepths, s.parenDepth+1)
+
+			default:
+				s.out.Write(s.css[start:s.pos])
+			}
+
+		case c == '(':
+			s.parenDepth++
+			s.copyTo(s.pos + 1)
+
+		case c == ')':
+			if n := len(s.imageSetDepths); n > 0 && s.imageSetDepths[n-1] == s.parenDepth {
+				s.imageSetDepths = s.imageSetDepths[:n-1]
+			}
+
+			if s.parenDepth > 0 {
+				s.parenDepth--
+			}
+
+			s.copyTo(s.pos + 1)
+
+		case c == ';' || c == '{' || c == '}':
+			s.importPending = false
+			s.copyTo(s.pos + 1)
+
+		default:
+			s.copyTo(s.pos + 1)
+		}
+	}
+}
+
+func (s *cssScanner) peek(offset int) byte {
+	if s.pos+offset < len(s.css) {
+		return s.css[s.pos+offset]
+	}
+
+	return 0
+}
+
+func (s *cssScanner) copyTo(end int) {
+	s.out.Write(s.css[s.pos:end])
+	s.pos = end
+}
+
+// Scans an identifier starting at the current position and returns its
+// unescaped value
+func (s *cssScanner) scanIdent() string {
+	var value bytes.Buffer
+
+	for s.pos < len(s.css) {
+		c := s.css[s.pos]
+
+		if c == '\\' && s.peek(1) != '\n' && s.pos+1 < len(s.css) {
+			value.WriteString(s.scanEscape())
+		} else if isCssIdentChar(c) {
+			value.WriteByte(c)
+			s.pos++
+		} else {
+			break
+		}
+	}
+
+	return value.String()
+}
+
+// Scans a quoted string starting at the current position and returns its
+// unescaped value
+func (s *cssScanner) scanString() string {
+	var value bytes.Buffer
+
+	quote := s.css[s.pos]
+	s.pos++
+
+	for s.pos < len(s.css) {
+		c := s.css[s.pos]
+
+		switch {
+		case c == quote:
+			s.pos++
+			return value.String()
+
+		case c == '\n':
+			// Unterminated string
+			return value.String()
+
+		case c == '\\' && s.peek(1) == '\n':
+			s.pos += 2
+
+		case c == '\\':
+			value.WriteString(s.scanEscape())
+
+		default:
+			value.WriteByte(c)
+			s.pos++
+		}
+	}
+
+	return value.String()
+}
+
+func (s *cssScanner) scanEscape() string {
+	// Skip the backslash
+	s.pos++
+
+	hexEnd := s.pos
+	for hexEnd < len(s.css) && hexEnd-s.pos < 6 && isHexDigit(s.css[hexEnd]) {
+		hexEnd++
+	}
+
+	if hexEnd == s.pos {
+		if s.pos >= len(s.css) {
+			return string(utf8.RuneError)
+		}
+
+		r, size := utf8.DecodeRune(s.css[s.pos:])
+		s.pos += size
+
+		return string(r)
+	}
+
+	code, _ := strconv.ParseUint(string(s.css[s.pos:hexEnd]), 16, 32)
+	s.pos = hexEnd
+
+	// A single whitespace terminates the escape
+	if s.pos < len(s.css) && isCssWhitespace(s.css[s.pos]) {
+		s.pos++
+	}
+
+	if code == 0 || code > utf8.MaxRune {
+		return string(utf8.RuneError)
+	}
+
+	return string(rune(code))
+}
+
+// Scans the argument of url( --- the current position is right behind the
+// opening parenthesis, start marks the beginning of the function name.
+func (s *cssScanner) scanUrl(start int) {
+	for s.pos < len(s.css) && isCssWhitespace(s.css[s.pos]) {
+		s.pos++
+	}
+
+	quote := byte(0)
+	var value bytes.Buffer
+
+	if c := s.peek(0); c == '"' || c == '\'' {
+		quote = c
+		value.WriteString(s.scanString())
+
+		for s.pos < len(s.css) && isCssWhitespace(s.css[s.pos]) {
+			s.pos++
+		}
+	} else {
+		for s.pos < len(s.css) && s.css[s.pos] != ')' {
+			c := s.css[s.pos]
+
+			if c == '\\' {
+				value.WriteString(s.scanEscape())
+			} else {
+				value.WriteByte(c)
+				s.pos++
+			}
+		}
+	}
+
+	if s.peek(0) != ')' {
+		// Malformed, leave it alone
+		s.out.Write(s.css[start:s.pos])
+		return
+	}
+
+	s.pos++
+
+	url := strings.TrimSpace(value.String())
+
+	if rewritten, ok := rewriteRemoteUrl(url, s.ctx); ok {
+		s.out.WriteString("url(")
+		if quote != 0 {
+			s.out.WriteString(escapeCssString(rewritten, quote))
+		} else {
+			s.out.WriteString(escapeCssUrl(rewritten))
+		}
+		s.out.WriteString(")")
+
+		s.rewritten = true
+	} else {
+		s.out.Write(s.css[start:s.pos])
+	}
+}
+
+func (s *cssScanner) emitUrl(raw []byte, value string, quote byte) {
+	if rewritten, ok := rewriteRemoteUrl(value, s.ctx); ok {
+		s.out.WriteString(escapeCssString(rewritten, quote))
+		s.rewritten = true
+	} else {
+		s.out.Write(raw)
+	}
+}
+
+func escapeCssString(value string, quote byte) string {
+	var out bytes.Buffer
+
+	out.WriteByte(quote)
+
+	for _, r := range value {
+		switch {
+		case r == rune(quote) || r == '\\':
+			out.WriteByte('\\')
+			out.WriteRune(r)
+
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&out, "\\%x ", r)
+
+		default:
+			out.WriteRune(r)
+		}
+	}
+
+	out.WriteByte(quote)
+
+	return out.String()
+}
+
+func escapeCssUrl(value string) string {
+	var out bytes.Buffer
+
+	for _, r := range value {
+		switch {
+		case r == '"' || r == '\'' || r == '(' || r == ')' || r == '\\':
+			out.WriteByte('\\')
+			out.WriteRune(r)
+
+		case r <= 0x20 || r == 0x7f:
+			fmt.Fprintf(&out, "\\%x ", r)
+
+		default:
+			out.WriteRune(r)
+		}
+	}
+
+	return out.String()
+}
+
+func isCssIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c >= 0x80
+}
+
+func isCssIdentChar(c byte) bool {
+	return isCssIdentStart(c) || c >= '0' && c <= '9' || c == '-'
+}
+
+func isCssWhitespace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func NewCssRewriter(rewriteRoutes []*regexp.Regexp) *CssRewriter {
+	return &CssRewriter{
+		rewriteRoutes: rewriteRoutes,
+	}
+}
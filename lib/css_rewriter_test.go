@@ -0,0 +1,49 @@
+package lib
+
+import (
+	"testing"
+)
+
+func assertCssRewritesTo(t *testing.T, original, expected string) {
+	ctx, err := newMockContext()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewritten := string(NewCssRewriter(nil).RewriteResponse([]byte(original), ctx))
+
+	if rewritten != expected {
+		t.Fatalf("rewrite failed, got %s, expected %s", rewritten, expected)
+	}
+}
+
+func TestCssUrl(t *testing.T) {
+	assertCssRewritesTo(t,
+		`a { background: url(http://foo.bar/a.png) no-repeat; src: URL( 'https://bar.baz/f.woff' ) }`,
+		`a { background: url(http://1.2.3.4:8888/a.png) no-repeat; src: url('http://4.3.2.1:9999/f.woff') }`)
+}
+
+func TestCssEscapes(t *testing.T) {
+	assertCssRewritesTo(t,
+		`a { background: url(http\3a //foo.bar/a\(1\).png); b: url("http:\2f\2f foo.bar/b.png") }`,
+		`a { background: url(http://1.2.3.4:8888/a\(1\).png); b: url("http://1.2.3.4:8888/b.png") }`)
+}
+
+func TestCssImport(t *testing.T) {
+	assertCssRewritesTo(t,
+		`@import "//foo.bar/base.css"; @import url(https://bar.baz/x.css) screen; a { content: "http://foo.bar" }`,
+		`@import "http://1.2.3.4:8888/base.css"; @import url(http://4.3.2.1:9999/x.css) screen; a { content: "http://foo.bar" }`)
+}
+
+func TestCssImageSet(t *testing.T) {
+	assertCssRewritesTo(t,
+		`a { background-image: -webkit-image-set("http://foo.bar/a.png" 1x, url(http://foo.bar/b.png) 2x); content: 'http://foo.bar/c' }`,
+		`a { background-image: -webkit-image-set("http://1.2.3.4:8888/a.png" 1x, url(http://1.2.3.4:8888/b.png) 2x); content: 'http://foo.bar/c' }`)
+}
+
+func TestCssComments(t *testing.T) {
+	assertCssRewritesTo(t,
+		`/* url(http://foo.bar/a.png) */ a { }`,
+		`/* url(http://foo.bar/a.png) */ a { }`)
+}
@@ -0,0 +1,35 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+)
+
+type CustomHeaderRewriter struct {
+	GenericHeaderRewriter
+	outgoing []string
+	incoming []string
+}
+
+func (c *CustomHeaderRewriter) RewriteHeaders(headers http.Header, ctx RequestContext) {
+	for _, key := range c.outgoing {
+		if c.GenericHeaderRewriter.RewriteSpecifiedHeaders([]string{key}, headers, ctx) {
+			ctx.Log(fmt.Sprintf("rewrote %s", key))
+		}
+	}
+}
+
+func (c *CustomHeaderRewriter) RewriteIncomingHeaders(headers http.Header, ctx RequestContext) {
+	for _, key := range c.incoming {
+		if c.GenericHeaderRewriter.RewriteSpecifiedIncomingHeaders([]string{key}, headers, ctx) {
+			ctx.Log(fmt.Sprintf("rewrote %s", key))
+		}
+	}
+}
+
+func NewCustomHeaderRewriter(outgoing, incoming []string) *CustomHeaderRewriter {
+	return &CustomHeaderRewriter{
+		outgoing: outgoing,
+		incoming: incoming,
+	}
+}
@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCustomHeaders(t *testing.T) {
+	ctx, err := newMockContext()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := http.Header{}
+	headers.Add("link", `<http://foo.bar/style.css>; rel=preload; as=style, <https://bar.baz/>; rel=canonical; title="<http://foo.bar>"`)
+	headers.Add("link", "</relative>; rel=next")
+	headers.Set("refresh", "5; url=http://foo.bar/next")
+	headers.Set("x-callback-url", "http://foo.bar/callback")
+	headers.Set("content-location", "http://foo.bar/doc")
+
+	NewCustomHeaderRewriter([]string{"link", "refresh", "x-callback-url"}, nil).RewriteHeaders(headers, ctx)
+
+	links := headers["Link"]
+
+	if links[0] != `<http://1.2.3.4:8888/style.css>; rel=preload; as=style, <http://4.3.2.1:9999/>; rel=canonical; title="<http://foo.bar>"` {
+		t.Fatalf("unexpected link header %s", links[0])
+	}
+
+	if links[1] != "</relative>; rel=next" {
+		t.Fatalf("unexpected link header %s", links[1])
+	}
+
+	if value := headers.Get("refresh"); value != "5; url=http://1.2.3.4:8888/next" {
+		t.Fatalf("unexpected refresh header %s", value)
+	}
+
+	if value := headers.Get("x-callback-url"); value != "http://1.2.3.4:8888/callback" {
+		t.Fatalf("unexpected x-callback-url header %s", value)
+	}
+
+	if value := headers.Get("content-location"); value != "http://foo.bar/doc" {
+		t.Fatalf("header not configured for rewriting was modified: %s", value)
+	}
+}
+
+func TestCustomIncomingHeaders(t *testing.T) {
+	ctx, err := newMockContext()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := http.Header{}
+	headers.Set("x-return-to", "http://1.2.3.4:8888/back")
+
+	NewCustomHeaderRewriter(nil, []string{"x-return-to"}).RewriteIncomingHeaders(headers, ctx)
+
+	if value := headers.Get("x-return-to"); value != "http://foo.bar/back" {
+		t.Fatalf("unexpected x-return-to header %s", value)
+	}
+}
@@ -0,0 +1,64 @@
+package lib
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+type FormRewriter struct {
+	rewriteRoutes []*regexp.Regexp
+}
+
+func (r *FormRewriter) MatchesIncoming(ctx RequestContext) bool {
+	if requestMediaType(ctx) != "application/x-www-form-urlencoded" {
+		return false
+	}
+
+	return matchesRewriteRoutes(r.rewriteRoutes, ctx.IncomingRequest().RequestURI)
+}
+
+func (r *FormRewriter) RewriteIncomingBody(body []byte, ctx RequestContext) []byte {
+	// Fields are rewritten one by one in order to preserve their order and
+	// the encoding of untouched values
+	fields := strings.Split(string(body), "&")
+	rewritten := false
+
+	for i, field := range fields {
+		key, value := field, ""
+		hasValue := false
+
+		if index := strings.Index(field, "="); index >= 0 {
+			key, value = field[:index], field[index+1:]
+			hasValue = true
+		}
+
+		if !hasValue {
+			continue
+		}
+
+		unescaped, err := url.QueryUnescape(value)
+		if err != nil {
+			continue
+		}
+
+		if replaced, ok := replaceLocals([]byte(unescaped), ctx); ok {
+			fields[i] = key + "=" + url.QueryEscape(string(replaced))
+			rewritten = true
+		}
+	}
+
+	if !rewritten {
+		return body
+	}
+
+	ctx.Log("form rewriter: request rewritten")
+
+	return []byte(strings.Join(fields, "&"))
+}
+
+func NewFormRewriter(rewriteRoutes []*regexp.Regexp) *FormRewriter {
+	return &FormRewriter{
+		rewriteRoutes: rewriteRoutes,
+	}
+}
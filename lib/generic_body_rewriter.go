@@ -1,7 +1,7 @@
 package lib
 
 import (
-	"bytes"
+	"io"
 	"regexp"
 )
 
@@ -10,32 +10,17 @@ type GenericBodyRewriter struct {
 }
 
 func (r *GenericBodyRewriter) Matches(ctx RequestContext) bool {
-	request := ctx.IncomingRequest()
-
-	if request.Header.Get("content-type") == "application/json" {
+	// JSON, HTML, CSS and event streams are handled by dedicated rewriters
+	switch responseMediaType(ctx) {
+	case "application/json", "text/html", "application/xhtml+xml", "text/css", "text/event-stream":
 		return false
 	}
 
-	for _, route := range r.rewriteRoutes {
-		if route.MatchString(ctx.RequestUrl()) {
-			return true
-		}
-	}
-
-	return false
+	return matchesRewriteRoutes(r.rewriteRoutes, ctx.RequestUrl())
 }
 
 func (*GenericBodyRewriter) RewriteResponse(response []byte, ctx RequestContext) []byte {
-	rewritten := false
-
-	for _, mapping := range ctx.HostMappings() {
-		if bytes.Contains(response, []byte(mapping.remote)) {
-			response = bytes.Replace(
-				response, []byte(mapping.remote), []byte(mapping.local), -1)
-
-			rewritten = true
-		}
-	}
+	response, rewritten := replaceRemotes(response, ctx)
 
 	if rewritten {
 		ctx.Log("generic body rewriter: body rewritten")
@@ -44,6 +29,17 @@ func (*GenericBodyRewriter) RewriteResponse(response []byte, ctx RequestContext)
 	return response
 }
 
+func (*GenericBodyRewriter) RewriteResponseStream(response io.Reader, ctx RequestContext) io.Reader {
+	rewritten := false
+
+	return newStreamReplacer(response, newRemoteHostMatcher(ctx, true), func() {
+		if !rewritten {
+			ctx.Log("generic body rewriter: body rewritten")
+			rewritten = true
+		}
+	})
+}
+
 func NewGenericResponseRewriter(rewriteRoutes []*regexp.Regexp) *GenericBodyRewriter {
 	return &GenericBodyRewriter{
 		rewriteRoutes: rewriteRoutes,
@@ -7,38 +7,93 @@ import (
 
 type GenericHeaderRewriter struct{}
 
-func (*GenericHeaderRewriter) RewriteSpecifiedHeaders(keys []string, headers http.Header, ctx RequestContext) (rewritten bool) {
+func (r *GenericHeaderRewriter) RewriteSpecifiedHeaders(keys []string, headers http.Header, ctx RequestContext) (rewritten bool) {
+	return r.rewriteSpecifiedHeaders(keys, headers, newRemoteHostMatcher(ctx, true))
+}
+
+func (r *GenericHeaderRewriter) RewriteSpecifiedIncomingHeaders(keys []string, headers http.Header, ctx RequestContext) (rewritten bool) {
+	return r.rewriteSpecifiedHeaders(keys, headers, newLocalHostMatcher(ctx, true))
+}
+
+func (*GenericHeaderRewriter) rewriteSpecifiedHeaders(keys []string, headers http.Header, matcher *hostMatcher) (rewritten bool) {
 	for _, key := range keys {
+		values := headers[http.CanonicalHeaderKey(key)]
 
-		if value := headers.Get(key); value != "" {
-			for _, mapping := range ctx.HostMappings() {
-				if strings.Contains(value, mapping.remote) {
-					value = strings.Replace(value, mapping.remote, mapping.local, -1)
-					rewritten = true
-				}
+		for i, value := range values {
+			if value, ok := rewriteHeaderValue(key, value, matcher); ok {
+				values[i] = value
+				rewritten = true
 			}
-
-			headers.Set(key, value)
 		}
 	}
 
 	return
 }
 
-func (*GenericHeaderRewriter) RewriteSpecifiedIncomingHeaders(keys []string, headers http.Header, ctx RequestContext) (rewritten bool) {
-	for _, key := range keys {
+// Structured headers are parsed in order to only touch the URLs within
+func rewriteHeaderValue(key, value string, matcher *hostMatcher) (string, bool) {
+	switch strings.ToLower(key) {
+	case "link":
+		return rewriteLinkHeader(value, matcher)
+
+	case "refresh":
+		match := metaRefreshPattern.FindStringSubmatch(value)
+
+		if match == nil {
+			return value, false
+		}
+
+		if url, ok := matcher.replaceString(match[2]); ok {
+			return match[1] + url + match[3], true
+		}
+
+		return value, false
+	}
 
-		if value := headers.Get(key); value != "" {
-			for _, mapping := range ctx.HostMappings() {
-				if strings.Contains(value, mapping.local) {
-					value = strings.Replace(value, mapping.local, mapping.remote, -1)
-					rewritten = true
-				}
+	return matcher.replaceString(value)
+}
+
+// Rewrites the URI references in a Link header, e.g.
+// <http://foo.bar/style.css>; rel=preload; as=style, <http://foo.bar/>; rel=canonical
+func rewriteLinkHeader(value string, matcher *hostMatcher) (string, bool) {
+	var out strings.Builder
+
+	rewritten := false
+	quoted := false
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+
+		switch {
+		case quoted && c == '\\' && i+1 < len(value):
+			out.WriteString(value[i : i+2])
+			i++
+			continue
+
+		case c == '"':
+			quoted = !quoted
+
+		case !quoted && c == '<':
+			end := strings.IndexByte(value[i:], '>')
+
+			if end < 0 {
+				break
 			}
 
-			headers.Set(key, value)
+			url, ok := matcher.replaceString(value[i+1 : i+end])
+			rewritten = rewritten || ok
+
+			out.WriteString("<" + url + ">")
+			i += end
+			continue
 		}
+
+		out.WriteByte(c)
 	}
 
-	return
+	if !rewritten {
+		return value, false
+	}
+
+	return out.String(), true
 }
@@ -0,0 +1,411 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Bodies are only recorded up to this size
+const harBodyLimit = 1 << 20
+
+// The subset of HAR 1.2 written by the recorder. Fields starting with an
+// underscore are custom: the response as received from the upstream, the
+// rewritten upstream URL and the rewrite log.
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime  time.Time    `json:"startedDateTime"`
+	Time             float64      `json:"time"`
+	Request          harRequest   `json:"request"`
+	Response         harResponse  `json:"response"`
+	Cache            struct{}     `json:"cache"`
+	Timings          harTimings   `json:"timings"`
+	UpstreamUrl      string       `json:"_upstreamUrl,omitempty"`
+	UpstreamResponse *harResponse `json:"_upstreamResponse,omitempty"`
+	ReproLog         []string     `json:"_reproLog"`
+	Comment          string       `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	Url         string         `json:"url"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HttpVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectUrl string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string         `json:"mimeType"`
+	Params   []harNameValue `json:"params"`
+	Text     string         `json:"text"`
+	Encoding string         `json:"_encoding,omitempty"`
+	Comment  string         `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size        int    `json:"size"`
+	Compression int    `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	Encoding    string `json:"encoding,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+}
+
+// Timings are measured by the proxy: send covers building the upstream
+// request, wait the time until the upstream response headers arrive and
+// receive sending the rewritten response to the client
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	Dns     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// Keeps the start of a body while it passes through the proxy. Bodies that are
+// passed on compressed are decoded when the entry is written.
+type bodyCapture struct {
+	reader   io.Reader
+	encoding string
+	data     bytes.Buffer
+	size     int
+	mutex    sync.Mutex
+}
+
+func (c *bodyCapture) Read(b []byte) (n int, err error) {
+	n, err = c.reader.Read(b)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.size += n
+
+	if room := harBodyLimit - c.data.Len(); room > 0 {
+		if room > n {
+			room = n
+		}
+
+		c.data.Write(b[:room])
+	}
+
+	return
+}
+
+// Streaming rewriters are terminated by closing their reader
+func (c *bodyCapture) Close() error {
+	if closer, ok := c.reader.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// Returns the captured body as HAR text, binary data is base64 encoded. For
+// compressed bodies, size is the decoded size and compression the bytes saved.
+func (c *bodyCapture) text() (text, encoding, comment string, size, compression int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	data := c.data.Bytes()
+	size = c.size
+	truncated := c.size > len(data)
+
+	if decoded, ok := c.decode(data); ok {
+		if !truncated {
+			size = len(decoded)
+			compression = len(decoded) - c.size
+		}
+
+		if len(decoded) > harBodyLimit {
+			decoded = decoded[:harBodyLimit]
+			truncated = true
+		}
+
+		data = decoded
+	}
+
+	if utf8.Valid(data) {
+		text = string(data)
+	} else {
+		text = base64.StdEncoding.EncodeToString(data)
+		encoding = "base64"
+	}
+
+	if truncated {
+		comment = "truncated"
+	}
+
+	return
+}
+
+// Truncated bodies are decoded as far as possible
+func (c *bodyCapture) decode(data []byte) (decoded []byte, ok bool) {
+	encoding := normalizeEncoding(c.encoding)
+
+	if encoding == "" || encoding == "identity" || !isSupportedEncoding(encoding) || len(data) == 0 {
+		return
+	}
+
+	reader, err := newDecodingReader(encoding, bytes.NewReader(data))
+
+	if err != nil {
+		return
+	}
+
+	defer reader.Close()
+
+	decoded, err = ioutil.ReadAll(reader)
+
+	return decoded, err == nil || len(decoded) > 0
+}
+
+// The recording of a single request. Recording is optional, so all methods
+// accept a nil exchange.
+type harExchange struct {
+	started       time.Time
+	upstreamStart time.Time
+	upstreamEnd   time.Time
+	upstreamUrl   string
+	err           error
+
+	requestBody  *bodyCapture
+	upstreamBody *bodyCapture
+	responseBody *bodyCapture
+}
+
+func newHarExchange(incoming *http.Request) (e *harExchange) {
+	e = &harExchange{
+		started: time.Now(),
+	}
+
+	if incoming.Body != nil && incoming.Body != http.NoBody {
+		e.requestBody = &bodyCapture{reader: incoming.Body}
+		incoming.Body = e.requestBody
+	}
+
+	return
+}
+
+func (e *harExchange) waiting(upstreamRequest *http.Request) {
+	if e != nil {
+		e.upstreamStart = time.Now()
+		e.upstreamUrl = upstreamRequest.URL.String()
+	}
+}
+
+func (e *harExchange) received(err error) {
+	if e != nil {
+		e.upstreamEnd = time.Now()
+		e.err = err
+	}
+}
+
+// The encoding is set if the body is passed on compressed
+func (e *harExchange) captureUpstreamBody(reader io.Reader, encoding string) io.Reader {
+	if e == nil {
+		return reader
+	}
+
+	e.upstreamBody = &bodyCapture{reader: reader, encoding: encoding}
+
+	return e.upstreamBody
+}
+
+func (e *harExchange) captureResponseBody(reader io.Reader, encoding string) io.Reader {
+	if e == nil {
+		return reader
+	}
+
+	e.responseBody = &bodyCapture{reader: reader, encoding: encoding}
+
+	return e.responseBody
+}
+
+func (e *harExchange) entry(ctx *requestContext) (entry harEntry) {
+	finished := time.Now()
+	incoming := ctx.incomingRequest
+
+	ctx.mutex.Lock()
+	entry.ReproLog = append([]string{}, ctx.logs...)
+	ctx.mutex.Unlock()
+
+	entry.StartedDateTime = e.started
+	entry.Time = milliseconds(finished.Sub(e.started))
+	entry.UpstreamUrl = e.upstreamUrl
+
+	entry.Request = harRequest{
+		Method:      incoming.Method,
+		Url:         ctx.RequestUrl(),
+		HttpVersion: incoming.Proto,
+		Cookies:     harCookies(incoming.Cookies()),
+		Headers:     harHeaders(incoming.Header),
+		QueryString: harQuery(incoming),
+		HeadersSize: -1,
+		BodySize:    0,
+	}
+
+	if e.requestBody != nil {
+		text, encoding, comment, size, _ := e.requestBody.text()
+
+		entry.Request.BodySize = size
+		entry.Request.PostData = &harPostData{
+			MimeType: incoming.Header.Get("content-type"),
+			Params:   []harNameValue{},
+			Text:     text,
+			Encoding: encoding,
+			Comment:  comment,
+		}
+	}
+
+	entry.Timings = harTimings{Blocked: -1, Dns: -1, Connect: -1}
+
+	if e.upstreamStart.IsZero() {
+		e.upstreamStart = finished
+	}
+
+	if e.upstreamEnd.IsZero() {
+		e.upstreamEnd = finished
+	}
+
+	entry.Timings.Send = milliseconds(e.upstreamStart.Sub(e.started))
+	entry.Timings.Wait = milliseconds(e.upstreamEnd.Sub(e.upstreamStart))
+	entry.Timings.Receive = milliseconds(finished.Sub(e.upstreamEnd))
+
+	if e.err != nil || ctx.upstreamResponse == nil {
+		entry.Response = harResponse{
+			Status:      http.StatusBadGateway,
+			StatusText:  http.StatusText(http.StatusBadGateway),
+			HttpVersion: incoming.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		}
+
+		if e.err != nil {
+			entry.Comment = e.err.Error()
+		}
+
+		return
+	}
+
+	upstream := ctx.upstreamResponse
+	upstreamResponse := harResponseFor(upstream.StatusCode, upstream.Proto, upstream.Header, e.upstreamBody)
+	entry.UpstreamResponse = &upstreamResponse
+
+	// The outgoing headers are only set up if the response was sent
+	headers := ctx.outgoingHeaders
+	if headers == nil {
+		headers = upstream.Header
+	}
+
+	entry.Response = harResponseFor(upstream.StatusCode, incoming.Proto, headers, e.responseBody)
+
+	return
+}
+
+func harResponseFor(status int, proto string, header http.Header, body *bodyCapture) (r harResponse) {
+	r = harResponse{
+		Status:      status,
+		StatusText:  http.StatusText(status),
+		HttpVersion: proto,
+		Cookies:     harCookies((&http.Response{Header: header}).Cookies()),
+		Headers:     harHeaders(header),
+		RedirectUrl: header.Get("location"),
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+
+	r.Content.MimeType = header.Get("content-type")
+
+	if body != nil {
+		r.Content.Text, r.Content.Encoding, r.Content.Comment, r.Content.Size, r.Content.Compression = body.text()
+	}
+
+	return
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	headers := make([]harNameValue, 0, len(header))
+
+	for key, values := range header {
+		for _, value := range values {
+			headers = append(headers, harNameValue{key, value})
+		}
+	}
+
+	// Map iteration is random, but recordings should be easy to diff
+	sort.SliceStable(headers, func(i, j int) bool {
+		return headers[i].Name < headers[j].Name
+	})
+
+	return headers
+}
+
+func harCookies(cookies []*http.Cookie) []harNameValue {
+	result := make([]harNameValue, 0, len(cookies))
+
+	for _, cookie := range cookies {
+		result = append(result, harNameValue{cookie.Name, cookie.Value})
+	}
+
+	return result
+}
+
+func harQuery(request *http.Request) []harNameValue {
+	query := make([]harNameValue, 0)
+
+	for key, values := range request.URL.Query() {
+		for _, value := range values {
+			query = append(query, harNameValue{key, value})
+		}
+	}
+
+	sort.SliceStable(query, func(i, j int) bool {
+		return query[i].Name < query[j].Name
+	})
+
+	return query
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,156 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The end of a HAR file after the entries
+var harTrailer = []byte("\n]}}\n")
+
+// Writes all exchanges of a session to HAR files in a directory. Each session
+// starts a new file, and so does every maxSize bytes if set. Files are valid HAR
+// after every entry, so they can be inspected while recording.
+type harRecorder struct {
+	dir     string
+	maxSize int64
+	session string
+	log     io.Writer
+
+	file    *os.File
+	part    int
+	size    int64
+	entries int
+	closed  bool
+	mutex   sync.Mutex
+}
+
+func newHarRecorder(dir string, maxSize int64, log io.Writer) (r *harRecorder, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	r = &harRecorder{
+		dir:     dir,
+		maxSize: maxSize,
+		session: time.Now().Format("20060102-150405"),
+		log:     log,
+	}
+
+	return
+}
+
+func (r *harRecorder) record(ctx *requestContext) {
+	data, err := json.Marshal(ctx.exchange.entry(ctx))
+
+	if err == nil {
+		err = r.write(data)
+	}
+
+	if err != nil {
+		fmt.Fprintf(r.log, "error recording %s: %v\n", ctx.RequestUrl(), err)
+	}
+}
+
+func (r *harRecorder) write(entry []byte) (err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	if r.file != nil && r.maxSize > 0 && r.entries > 0 && r.size+int64(len(entry)) > r.maxSize {
+		r.closeFile()
+	}
+
+	if r.file == nil {
+		if err = r.openFile(); err != nil {
+			return
+		}
+	}
+
+	separator := []byte("\n")
+	if r.entries > 0 {
+		separator = []byte(",\n")
+	}
+
+	// The trailer is overwritten by the next entry
+	if _, err = r.file.WriteAt(append(append(separator, entry...), harTrailer...), r.size); err != nil {
+		return
+	}
+
+	r.size += int64(len(separator) + len(entry))
+	r.entries++
+
+	return
+}
+
+func (r *harRecorder) openFile() (err error) {
+	var file *os.File
+	var fname string
+
+	// Sessions started within the same second must not overwrite each other
+	for file == nil {
+		r.part++
+
+		name := "go-repro-" + r.session
+		if r.part > 1 {
+			name += fmt.Sprintf("-%d", r.part)
+		}
+
+		fname = filepath.Join(r.dir, name+".har")
+		file, err = os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+
+		if err != nil && !os.IsExist(err) {
+			return
+		}
+	}
+
+	header, _ := json.Marshal(map[string]harLog{
+		"log": {
+			Version: "1.2",
+			Creator: harCreator{"go-repro", Version()},
+			Entries: []harEntry{},
+		},
+	})
+
+	// Cut off the closing brackets of the empty entries
+	header = header[:len(header)-len("]}}")]
+
+	if _, err = file.Write(append(header, harTrailer...)); err != nil {
+		file.Close()
+		return
+	}
+
+	r.file = file
+	r.size = int64(len(header))
+	r.entries = 0
+
+	fmt.Fprintf(r.log, "recording traffic to %s\n", fname)
+
+	return
+}
+
+func (r *harRecorder) closeFile() {
+	r.file.Close()
+	r.file = nil
+}
+
+func (r *harRecorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.closed = true
+
+	if r.file != nil {
+		r.closeFile()
+	}
+
+	return nil
+}
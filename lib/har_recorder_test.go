@@ -0,0 +1,235 @@
+package lib
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readHar(t *testing.T, fname string) (har struct{ Log harLog }) {
+	data, err := ioutil.ReadFile(fname)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = json.Unmarshal(data, &har); err != nil {
+		t.Fatalf("invalid HAR file %s: %v", fname, err)
+	}
+
+	return
+}
+
+func TestHarRecording(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-repro-har")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	var upstreamUrl string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		w.Header().Set("content-type", "text/html")
+		w.Header().Set("set-cookie", "session=1")
+		fmt.Fprintf(w, `<a href="%s/%s"></a>`, upstreamUrl, body)
+	}))
+	defer upstream.Close()
+
+	upstreamUrl = upstream.URL
+
+	proxy := httptest.NewUnstartedServer(nil)
+
+	cfg := NewConfig()
+	cfg.SetLog(ioutil.Discard)
+	cfg.AddRewriteRoute(".")
+	cfg.AddMapping(proxy.Listener.Addr().String(), upstream.URL)
+	cfg.SetRecording(dir)
+
+	r, err := NewRepro(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.Config.Handler = r.proxies[0]
+	proxy.Start()
+	defer proxy.Close()
+
+	for _, page := range []string{"first", "second"} {
+		response, err := http.Post(proxy.URL+"/form?page="+page, "text/plain", strings.NewReader(page))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response.Body.Close()
+	}
+
+	r.recorder.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.har"))
+
+	if len(files) != 1 {
+		t.Fatalf("expected a single HAR file, got %v", files)
+	}
+
+	har := readHar(t, files[0])
+
+	if har.Log.Version != "1.2" || len(har.Log.Entries) != 2 {
+		t.Fatalf("unexpected HAR log %v", har.Log)
+	}
+
+	entry := har.Log.Entries[1]
+
+	if entry.Request.Url != proxy.URL+"/form?page=second" || entry.Request.PostData.Text != "second" {
+		t.Fatalf("unexpected request %v", entry.Request)
+	}
+
+	if len(entry.Request.QueryString) != 1 || entry.Request.QueryString[0].Value != "second" {
+		t.Fatalf("unexpected query %v", entry.Request.QueryString)
+	}
+
+	if entry.UpstreamUrl != upstream.URL+"/form?page=second" {
+		t.Fatalf("unexpected upstream URL %s", entry.UpstreamUrl)
+	}
+
+	if text := entry.UpstreamResponse.Content.Text; text != fmt.Sprintf(`<a href="%s/second"></a>`, upstream.URL) {
+		t.Fatalf("unexpected upstream body %s", text)
+	}
+
+	if text := entry.Response.Content.Text; text != fmt.Sprintf(`<a href="%s/second"></a>`, proxy.URL) {
+		t.Fatalf("unexpected response body %s", text)
+	}
+
+	if len(entry.Response.Cookies) != 1 || entry.Response.Cookies[0].Name != "session" {
+		t.Fatalf("unexpected cookies %v", entry.Response.Cookies)
+	}
+
+	if len(entry.ReproLog) == 0 {
+		t.Fatal("rewrite log is missing")
+	}
+
+	if entry.Timings.Wait < 0 || entry.Time < entry.Timings.Wait {
+		t.Fatalf("unexpected timings %v", entry.Timings)
+	}
+}
+
+func TestHarCompressedBody(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-repro-har")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	body := strings.Repeat("compressed body ", 100)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/plain")
+		w.Header().Set("content-encoding", "gzip")
+
+		writer := gzip.NewWriter(w)
+		writer.Write([]byte(body))
+		writer.Close()
+	}))
+	defer upstream.Close()
+
+	proxy := httptest.NewUnstartedServer(nil)
+
+	cfg := NewConfig()
+	cfg.SetLog(ioutil.Discard)
+	cfg.AddMapping(proxy.Listener.Addr().String(), upstream.URL)
+	cfg.SetRecording(dir)
+
+	r, err := NewRepro(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.Config.Handler = r.proxies[0]
+	proxy.Start()
+	defer proxy.Close()
+
+	// The client accepts gzip, so the body is passed on compressed
+	request, _ := http.NewRequest("GET", proxy.URL+"/", nil)
+	request.Header.Set("accept-encoding", "gzip")
+
+	response, err := (&http.Transport{DisableCompression: true}).RoundTrip(request)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	if response.Header.Get("content-encoding") != "gzip" {
+		t.Fatal("body should be passed on compressed")
+	}
+
+	r.recorder.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.har"))
+
+	if len(files) != 1 {
+		t.Fatalf("expected a single HAR file, got %v", files)
+	}
+
+	entry := readHar(t, files[0]).Log.Entries[0]
+
+	for _, content := range []harContent{entry.UpstreamResponse.Content, entry.Response.Content} {
+		if content.Text != body || content.Encoding != "" || content.Size != len(body) || content.Compression <= 0 {
+			t.Fatalf("body not decoded: %v", content)
+		}
+	}
+}
+
+func TestHarRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-repro-har")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	recorder, err := newHarRecorder(dir, 100, ioutil.Discard)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err = recorder.write([]byte(fmt.Sprintf(`{"comment":"%s"}`, strings.Repeat("x", 60)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recorder.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.har"))
+
+	if len(files) != 3 {
+		t.Fatalf("expected three HAR files, got %v", files)
+	}
+
+	for _, fname := range files {
+		if har := readHar(t, fname); len(har.Log.Entries) != 1 {
+			t.Fatalf("unexpected entries in %s", fname)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Absolute URLs in the encodings understood by the host matcher
+var urlOriginPattern = regexp.MustCompile(`(?i)\b(https?|wss?)(?:://|:\\/\\/|%3A%2F%2F)([a-z0-9-]+(?:\.[a-z0-9-]+)+)(?:(?::|%3A)(\d+))?`)
+
+// Bounds the memory used by pages referencing many unmapped hosts. Hosts
+// beyond the limit are not listed, but still mapped if allowed.
+const maxDiscoveredHosts = 1000
+
+// Collects the hosts that are referenced by responses, but not mapped.
+// Hosts matching the allowlist are mapped to ports from a range.
+type hostDiscovery struct {
+	allowlist []string
+	ports     *portRange
+	log       io.Writer
+
+	mutex sync.Mutex
+	hosts map[string]*DiscoveredHost
+	order []*DiscoveredHost
+}
+
+type DiscoveredHost struct {
+	Origin       string    `json:"origin"`
+	ReferencedBy string    `json:"referenced_by"`
+	FirstSeen    time.Time `json:"first_seen"`
+	References   int       `json:"references"`
+	Mapped       bool      `json:"mapped"`
+}
+
+// Allowlist entries are host names with shell-style wildcards, e.g. *.partner.com
+func validateDiscoveryPattern(pattern string) (err error) {
+	_, err = path.Match(pattern, "")
+
+	return
+}
+
+// The caller holds the lock
+func (d *hostDiscovery) allows(remote string) bool {
+	host := parseOrigin(remote).host
+
+	for _, pattern := range d.allowlist {
+		if matched, _ := path.Match(strings.ToLower(pattern), host); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Records a reference to an unmapped origin and returns the port range if the
+// origin should be mapped
+func (d *hostDiscovery) record(remote, referrer string) *portRange {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	host, ok := d.hosts[remote]
+
+	if !ok && len(d.order) < maxDiscoveredHosts {
+		host = &DiscoveredHost{
+			Origin:       remote,
+			ReferencedBy: referrer,
+			FirstSeen:    time.Now(),
+		}
+
+		if d.hosts == nil {
+			d.hosts = make(map[string]*DiscoveredHost)
+		}
+
+		d.hosts[remote] = host
+		d.order = append(d.order, host)
+
+		fmt.Fprintf(d.log, "discovered unmapped host %s, referenced by %s\n", remote, referrer)
+
+		if len(d.order) == maxDiscoveredHosts {
+			fmt.Fprintf(d.log, "discovered %d hosts, not listing any further ones\n", maxDiscoveredHosts)
+		}
+	}
+
+	if host != nil {
+		host.References++
+	}
+
+	if d.ports == nil || !d.allows(remote) {
+		return nil
+	}
+
+	return d.ports
+}
+
+// Applies the allowlist and ports of a reloaded config
+func (d *hostDiscovery) configure(allowlist []string, ports *portRange) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.allowlist = allowlist
+	d.ports = ports
+}
+
+func (d *hostDiscovery) markMapped(remote string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if host, ok := d.hosts[remote]; ok {
+		host.Mapped = true
+	}
+}
+
+func (d *hostDiscovery) snapshot() []DiscoveredHost {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	hosts := make([]DiscoveredHost, 0, len(d.order))
+
+	for _, h := range d.order {
+		hosts = append(hosts, *h)
+	}
+
+	return hosts
+}
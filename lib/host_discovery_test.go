@@ -0,0 +1,171 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHostDiscovery(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			fmt.Fprint(w, "upstream")
+			return
+		}
+
+		w.Header().Set("content-type", "application/json")
+		fmt.Fprint(w, `{"partner":"https://partner.example.com/x","sibling":"http://api.sibling.test/y"}`)
+	}))
+	defer upstream.Close()
+
+	proxy := httptest.NewUnstartedServer(nil)
+	port := freePort(t)
+
+	cfg := NewConfig()
+	cfg.SetLog(ioutil.Discard)
+	cfg.AddRewriteRoute(".")
+	cfg.AddMapping(proxy.Listener.Addr().String(), upstream.URL)
+	cfg.SetDiscovery(true)
+
+	if err := cfg.AddDiscoveryHost("*.sibling.test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cfg.SetDiscoveryPorts(fmt.Sprintf("127.0.0.1:%d-%d", port, port+10)); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRepro(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		for _, p := range r.proxies[1:] {
+			p.server.Close()
+		}
+	}()
+
+	proxy.Config.Handler = r.proxies[0]
+	proxy.Start()
+	defer proxy.Close()
+
+	response, err := http.Get(proxy.URL + "/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body map[string]string
+	err = json.NewDecoder(response.Body).Decode(&body)
+	response.Body.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mappings := r.registry.Mappings()
+
+	if len(mappings) != 2 || mappings[1].remote != "http://api.sibling.test" {
+		t.Fatalf("expected the sibling to be mapped, got %v", mappings)
+	}
+
+	if body["partner"] != "https://partner.example.com/x" {
+		t.Fatalf("unexpected partner %s", body["partner"])
+	}
+
+	if body["sibling"] != "http://"+mappings[1].local+"/y" {
+		t.Fatalf("unexpected sibling %s", body["sibling"])
+	}
+
+	response, err = http.Get(proxy.URL + "/.go-repro/discovered")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hosts []DiscoveredHost
+	err = json.NewDecoder(response.Body).Decode(&hosts)
+	response.Body.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hosts) != 2 {
+		t.Fatalf("expected two discovered hosts, got %v", hosts)
+	}
+
+	for _, host := range hosts {
+		if host.Mapped != (host.Origin == "http://api.sibling.test") {
+			t.Fatalf("unexpected state of %s", host.Origin)
+		}
+
+		if host.ReferencedBy != proxy.URL+"/" {
+			t.Fatalf("unexpected referrer %s", host.ReferencedBy)
+		}
+	}
+
+	// Without onboarding, the other paths belong to the upstream
+	response, err = http.Get(proxy.URL + "/.go-repro/ca.pem")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	if string(data) != "upstream" {
+		t.Fatalf("request was not proxied, got %s", data)
+	}
+}
+
+func TestHostDiscoveryLimit(t *testing.T) {
+	discovery := &hostDiscovery{log: ioutil.Discard}
+
+	for i := 0; i < maxDiscoveredHosts+10; i++ {
+		discovery.record(fmt.Sprintf("http://host%d.test", i), "http://foo.bar/")
+	}
+
+	discovery.record("http://host0.test", "http://foo.bar/")
+	discovery.markMapped("http://host0.test")
+
+	hosts := discovery.snapshot()
+
+	if len(hosts) != maxDiscoveredHosts {
+		t.Fatalf("expected %d hosts, got %d", maxDiscoveredHosts, len(hosts))
+	}
+
+	if hosts[0].Origin != "http://host0.test" || hosts[0].References != 2 || !hosts[0].Mapped {
+		t.Fatalf("unexpected first host %v", hosts[0])
+	}
+}
+
+func TestHostDiscoveryConfigure(t *testing.T) {
+	discovery := &hostDiscovery{log: ioutil.Discard}
+	ports, _ := parsePortRange("127.0.0.1:9100-9199")
+	done := make(chan bool)
+
+	go func() {
+		for i := 0; i < 100; i++ {
+			discovery.configure([]string{"*.partner.test"}, &ports)
+		}
+
+		close(done)
+	}()
+
+	for i := 0; i < 100; i++ {
+		discovery.record("http://api.partner.test", "http://foo.bar/")
+	}
+
+	<-done
+
+	if discovery.record("http://api.partner.test", "http://foo.bar/") == nil {
+		t.Fatal("allowed host should get the port range")
+	}
+}
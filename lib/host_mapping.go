@@ -15,17 +15,36 @@ func buildHostMappings(mappings []Mapping, requestHostvar string) (hostMappings
 
 	requestHost, _, requestErr := splitHostPort(requestHostvar)
 
+	// Requests to nip.io virtual hosts carry the IP within the host name
+	if _, ip, ok := parseNipIoHost(requestHost); ok {
+		requestHost = ip
+	}
+
 	for _, mapping := range mappings {
 		h := HostMapping{
 			remote: mapping.remote,
 		}
 
+		scheme := mapping.localScheme() + "://"
+
 		localHost, localPort, localErr := splitHostPort(mapping.local)
 
 		if localErr == nil && requestErr == nil && localHost == "0.0.0.0" {
-			h.local = "http://" + requestHost + ":" + localPort
+			localHost = requestHost
+		}
+
+		switch mapping.virtualHost {
+		case VirtualHostByHost:
+			localHost = mapping.remoteHostname()
+
+		case VirtualHostByNipIo:
+			localHost = mapping.remoteHostname() + "." + localHost + ".nip.io"
+		}
+
+		if localErr == nil {
+			h.local = scheme + localHost + ":" + localPort + mapping.virtualHostPath()
 		} else {
-			h.local = "http://" + mapping.local
+			h.local = scheme + mapping.local + mapping.virtualHostPath()
 		}
 
 		hostMappings = append(hostMappings, h)
@@ -48,3 +48,19 @@ func TestAllInterfaces(t *testing.T) {
 		t.Fatalf("expected http://192.168.0.1:8080, got %s", hostMappings[0].local)
 	}
 }
+
+func TestLocalTLS(t *testing.T) {
+	mappings := []Mapping{
+		{
+			local:    "0.0.0.0:8443",
+			remote:   "foo.bar.com",
+			localTLS: true,
+		},
+	}
+
+	hostMappings := buildHostMappings(mappings, "192.168.0.1:8090")
+
+	if hostMappings[0].local != "https://192.168.0.1:8443" {
+		t.Fatalf("expected https://192.168.0.1:8443, got %s", hostMappings[0].local)
+	}
+}
@@ -0,0 +1,530 @@
+package lib
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+)
+
+// Despite the name, origins of path-prefixed remotes include the path
+type urlOrigin struct {
+	scheme string
+	host   string
+	port   string
+	path   string
+}
+
+type hostReplacement struct {
+	from urlOrigin
+	to   urlOrigin
+}
+
+type hostMatch struct {
+	start       int
+	end         int
+	replacement []byte
+}
+
+// Finds the different encodings of a set of origins in text and replaces them
+// with the corresponding origin in the same encoding. Recognized are
+//
+//	http://foo.bar       literal URLs
+//	http:\/\/foo.bar     URLs in JSON strings
+//	http%3A%2F%2Ffoo.bar percent-encoded URLs, also double encoded
+//	//foo.bar            scheme-relative URLs in all of the above encodings
+//	foo.bar              bare hosts (optional)
+//
+// Hosts only match as a whole, so http://foo.bar matches neither
+// http://foo.bar.baz nor http://foo.bar:8080 .
+type hostMatcher struct {
+	replacements []hostReplacement
+	bareHosts    bool
+
+	// Bytes before and after a host that are needed to decide on a match
+	maxPrefixLength int
+	maxSuffixLength int
+
+	// Wildcard remotes with the host being the suffix, e.g. .app.dev . Matching
+	// hosts are mapped on first sight, as are all others if discovering.
+	wildcards   []urlOrigin
+	discovering bool
+	resolve     func(remote string) (local string, ok bool)
+	unresolved  map[urlOrigin]bool
+}
+
+type urlSeparator struct {
+	separator string
+	colon     string
+	slash     string
+}
+
+var urlSeparators = []urlSeparator{
+	{"://", ":", "/"},
+	{`:\/\/`, ":", `\/`},
+	{"%3A%2F%2F", "%3A", "%2F"},
+	{"%3a%2f%2f", "%3a", "%2f"},
+	{":%2F%2F", ":", "%2F"},
+	{":%2f%2f", ":", "%2f"},
+	{"%253A%252F%252F", "%253A", "%252F"},
+	{"%253a%252f%252f", "%253a", "%252f"},
+}
+
+var relativeUrlSeparators = []urlSeparator{
+	{`\/\/`, ":", `\/`},
+	{"//", ":", "/"},
+	{"%2F%2F", "%3A", "%2F"},
+	{"%2f%2f", "%3a", "%2f"},
+	{"%252F%252F", "%253A", "%252F"},
+	{"%252f%252f", "%253a", "%252f"},
+}
+
+var colonEncodings = []string{":", "%3A", "%3a", "%253A", "%253a"}
+
+func parseOrigin(origin string) (o urlOrigin) {
+	u, err := url.Parse(origin)
+
+	if err != nil {
+		return
+	}
+
+	o.scheme = strings.ToLower(u.Scheme)
+	o.host = u.Host
+	o.path = strings.TrimRight(u.EscapedPath(), "/")
+
+	// Take care of IPv6 literals
+	if i := strings.LastIndex(u.Host, ":"); i > strings.LastIndex(u.Host, "]") {
+		o.host, o.port = u.Host[:i], u.Host[i+1:]
+	}
+
+	return
+}
+
+func (o urlOrigin) String() string {
+	origin := o.scheme + "://" + o.host
+	if o.port != "" {
+		origin += ":" + o.port
+	}
+
+	return origin + o.path
+}
+
+// Maps remote origins to local ones, for content sent to the client
+func newRemoteHostMatcher(ctx RequestContext, bareHosts bool) *hostMatcher {
+	preferred := make([]hostReplacement, 0, len(ctx.HostMappings()))
+	others := make([]hostReplacement, 0, len(ctx.HostMappings()))
+
+	// Scheme-relative URLs and bare hosts may match several mappings for the
+	// same host, so those with the scheme of the current upstream come first
+	scheme := currentRemoteScheme(ctx)
+
+	for _, mapping := range ctx.HostMappings() {
+		r := hostReplacement{
+			from: parseOrigin(mapping.remote),
+			to:   parseOrigin(mapping.local),
+		}
+
+		if r.from.scheme == scheme {
+			preferred = append(preferred, r)
+		} else {
+			others = append(others, r)
+		}
+	}
+
+	m := newHostMatcher(append(preferred, others...), bareHosts)
+
+	if resolver, ok := ctx.(hostResolver); ok {
+		m.addResolver(resolver)
+	}
+
+	return m
+}
+
+// Maps local origins to remote ones, for content sent by the client
+func newLocalHostMatcher(ctx RequestContext, bareHosts bool) *hostMatcher {
+	replacements := make([]hostReplacement, 0, len(ctx.HostMappings()))
+
+	for _, mapping := range ctx.HostMappings() {
+		replacements = append(replacements, hostReplacement{
+			from: parseOrigin(mapping.local),
+			to:   parseOrigin(mapping.remote),
+		})
+	}
+
+	return newHostMatcher(replacements, bareHosts)
+}
+
+func newHostMatcher(replacements []hostReplacement, bareHosts bool) *hostMatcher {
+	m := &hostMatcher{
+		bareHosts: bareHosts,
+	}
+
+	maxSchemeLength, maxHostLength := 0, 0
+
+	for _, r := range replacements {
+		if r.from.host == "" {
+			continue
+		}
+
+		m.replacements = append(m.replacements, r)
+
+		if len(r.from.scheme) > maxSchemeLength {
+			maxSchemeLength = len(r.from.scheme)
+		}
+
+		// Slashes in the path may be encoded as %252F
+		if length := len(r.from.host) + len(r.from.port) + 5*len(r.from.path); length > maxHostLength {
+			maxHostLength = length
+		}
+	}
+
+	// Scheme and separator plus the character in front of the scheme, host
+	// and port plus the encoded colon and the two characters deciding on the
+	// boundary after the host
+	m.maxPrefixLength = maxSchemeLength + len("%253A%252F%252F") + 1
+	m.maxSuffixLength = maxHostLength + len("%253A") + 2
+
+	return m
+}
+
+func (m *hostMatcher) addResolver(resolver hostResolver) {
+	m.wildcards = resolver.wildcardOrigins()
+	m.discovering = resolver.discoversHosts()
+	m.resolve = resolver.resolveRemote
+	m.unresolved = make(map[urlOrigin]bool)
+
+	for _, w := range m.wildcards {
+		if length := len(w.scheme) + len("%253A%252F%252F") + 1; length > m.maxPrefixLength {
+			m.maxPrefixLength = length
+		}
+
+		// The wildcard matches a single DNS label of up to 63 characters
+		if length := 63 + len(w.host) + len(w.port) + len("%253A") + 2; length > m.maxSuffixLength {
+			m.maxSuffixLength = length
+		}
+	}
+}
+
+// Maps the hosts matching a wildcard that are referenced by URLs in text, so
+// they are replaced like all others. If discovering, all unmapped hosts are
+// reported.
+func (m *hostMatcher) discover(text []byte, pos, hostLimit int) {
+	// Bare hosts are too vague in order to justify a new mapping
+	strict := hostMatcher{}
+
+	for _, w := range m.wildcards {
+		suffix := []byte(w.host)
+
+		for i := indexFrom(text, suffix, pos); i < len(text); i = indexFrom(text, suffix, i+1) {
+			h := i
+			for h > 0 && isHostChar(text[h-1]) {
+				h--
+			}
+
+			if h == i || h >= hostLimit {
+				continue
+			}
+
+			from := urlOrigin{
+				scheme: w.scheme,
+				host:   strings.ToLower(string(text[h : i+len(suffix)])),
+				port:   w.port,
+			}
+
+			if _, ok := strict.matchAt(text, h, pos, hostReplacement{from: from}); ok {
+				m.resolveOrigin(from)
+			}
+		}
+	}
+
+	if !m.discovering {
+		return
+	}
+
+	for _, match := range urlOriginPattern.FindAllSubmatchIndex(text[pos:], -1) {
+		if pos+match[4] >= hostLimit {
+			break
+		}
+
+		from := urlOrigin{
+			scheme: strings.ToLower(string(text[pos+match[2] : pos+match[3]])),
+			host:   strings.ToLower(string(text[pos+match[4] : pos+match[5]])),
+		}
+
+		if match[6] >= 0 {
+			from.port = string(text[pos+match[6] : pos+match[7]])
+		}
+
+		m.resolveOrigin(from)
+	}
+}
+
+func (m *hostMatcher) resolveOrigin(from urlOrigin) {
+	if m.unresolved[from] || m.knows(from) {
+		return
+	}
+
+	if local, ok := m.resolve(from.String()); ok {
+		m.replacements = append(m.replacements, hostReplacement{from, parseOrigin(local)})
+	} else {
+		m.unresolved[from] = true
+	}
+}
+
+// Checks whether the origin is mapped or local, regardless of paths
+func (m *hostMatcher) knows(origin urlOrigin) bool {
+	for _, r := range m.replacements {
+		for _, o := range []urlOrigin{r.from, r.to} {
+			if o.scheme == origin.scheme && strings.EqualFold(o.host, origin.host) && o.port == origin.port {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// A matcher for origins in the strict sense, e.g. for CORS headers
+func (m *hostMatcher) withoutPaths() *hostMatcher {
+	replacements := make([]hostReplacement, len(m.replacements))
+
+	for i, r := range m.replacements {
+		r.from.path, r.to.path = "", ""
+		replacements[i] = r
+	}
+
+	return newHostMatcher(replacements, m.bareHosts)
+}
+
+func (m *hostMatcher) replace(text []byte) (result []byte, rewritten bool) {
+	result, end, count := m.replaceUntil(text, 0, len(text))
+
+	if count == 0 {
+		return text, false
+	}
+
+	return append(result, text[end:]...), true
+}
+
+func (m *hostMatcher) replaceString(text string) (string, bool) {
+	result, rewritten := m.replace([]byte(text))
+
+	return string(result), rewritten
+}
+
+// Replaces all matches in text[pos:] whose host starts before hostLimit. The
+// result covers text[pos:end], with end being the end of the last match.
+func (m *hostMatcher) replaceUntil(text []byte, pos, hostLimit int) (result []byte, end int, count int) {
+	end = pos
+
+	if m.resolve != nil {
+		m.discover(text, pos, hostLimit)
+	}
+
+	// The next occurrence of each host, updated lazily in order to avoid
+	// searching the same text over and over again
+	occurrences := make([]int, len(m.replacements))
+	for i := range occurrences {
+		occurrences[i] = -1
+	}
+
+	for {
+		var match hostMatch
+		found := false
+
+		for i, r := range m.replacements {
+			for {
+				if occurrences[i] < end {
+					occurrences[i] = indexFrom(text, []byte(r.from.host), end)
+				}
+
+				if occurrences[i] >= hostLimit || occurrences[i] == len(text) {
+					break
+				}
+
+				if candidate, ok := m.matchAt(text, occurrences[i], end, r); ok {
+					if !found || candidate.start < match.start || (candidate.start == match.start && candidate.end > match.end) {
+						match = candidate
+						found = true
+					}
+
+					break
+				}
+
+				occurrences[i] = indexFrom(text, []byte(r.from.host), occurrences[i]+1)
+			}
+		}
+
+		if !found {
+			return
+		}
+
+		result = append(result, text[end:match.start]...)
+		result = append(result, match.replacement...)
+		end = match.end
+		count++
+	}
+}
+
+// Like bytes.Index, but returns len(text) if there is no match
+func indexFrom(text, pattern []byte, from int) int {
+	if from > len(text) {
+		return len(text)
+	}
+
+	if i := bytes.Index(text[from:], pattern); i >= 0 {
+		return from + i
+	}
+
+	return len(text)
+}
+
+// Checks whether the host found at offset h is part of an URL in one of the
+// known encodings. Matches must not start before pos.
+func (m *hostMatcher) matchAt(text []byte, h, pos int, r hostReplacement) (match hostMatch, ok bool) {
+	start := h
+	prefix := ""
+	colon, slash := ":", "/"
+	found := false
+
+	for _, s := range urlSeparators {
+		schemeEnd := h - len(s.separator)
+		schemeStart := schemeEnd - len(r.from.scheme)
+
+		if schemeStart < 0 || string(text[schemeEnd:h]) != s.separator ||
+			!strings.EqualFold(string(text[schemeStart:schemeEnd]), r.from.scheme) {
+			continue
+		}
+
+		// Some other scheme that ends with ours
+		if schemeStart > 0 && isSchemeChar(text[schemeStart-1]) {
+			return
+		}
+
+		start, prefix, colon, slash, found = schemeStart, r.to.scheme+s.separator, s.colon, s.slash, true
+		break
+	}
+
+	if !found {
+		for _, s := range relativeUrlSeparators {
+			separatorStart := h - len(s.separator)
+
+			if separatorStart < 0 || string(text[separatorStart:h]) != s.separator {
+				continue
+			}
+
+			// An URL with a different scheme
+			if hasColonSuffix(text[:separatorStart]) {
+				return
+			}
+
+			start, prefix, colon, slash, found = separatorStart, s.separator, s.colon, s.slash, true
+			break
+		}
+	}
+
+	if !found {
+		if !m.bareHosts || !isBareHostStart(text[:h]) {
+			return
+		}
+
+		// Hosts without domain or port are too generic
+		if r.from.port == "" && !strings.Contains(r.from.host, ".") {
+			return
+		}
+	}
+
+	if start < pos {
+		return
+	}
+
+	end := h + len(r.from.host)
+
+	portColon := ""
+	for _, c := range colonEncodings {
+		if bytes.HasPrefix(text[end:], []byte(c)) && end+len(c) < len(text) && isDigit(text[end+len(c)]) {
+			portColon = c
+			break
+		}
+	}
+
+	if r.from.port != "" {
+		if portColon == "" || !bytes.HasPrefix(text[end+len(portColon):], []byte(r.from.port)) {
+			return
+		}
+
+		end += len(portColon) + len(r.from.port)
+		colon = portColon
+	} else if portColon != "" {
+		return
+	}
+
+	if r.from.path != "" {
+		path := strings.Replace(r.from.path, "/", slash, -1)
+
+		if !bytes.HasPrefix(text[end:], []byte(path)) {
+			return
+		}
+
+		end += len(path)
+	}
+
+	if !isHostEnd(text[end:]) {
+		return
+	}
+
+	replacement := prefix + r.to.host
+	if r.to.port != "" {
+		replacement += colon + r.to.port
+	}
+
+	replacement += strings.Replace(r.to.path, "/", slash, -1)
+
+	return hostMatch{start, end, []byte(replacement)}, true
+}
+
+func hasColonSuffix(text []byte) bool {
+	for _, c := range colonEncodings {
+		if bytes.HasSuffix(text, []byte(c)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Bare hosts must not be part of another host, an email address or a path.
+// Percent-encoded characters end with a hex digit and are thus excluded, too.
+func isBareHostStart(before []byte) bool {
+	if len(before) == 0 {
+		return true
+	}
+
+	c := before[len(before)-1]
+
+	return !isHostChar(c) && c != '.' && c != '@' && c != '/' && c != '\\' && c != ':'
+}
+
+func isHostEnd(after []byte) bool {
+	if len(after) == 0 {
+		return true
+	}
+
+	if isHostChar(after[0]) {
+		return false
+	}
+
+	// A subdomain, but not the end of a sentence
+	return !(after[0] == '.' && len(after) > 1 && isHostChar(after[1]))
+}
+
+func isHostChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || isDigit(c) || c == '-' || c == '_'
+}
+
+func isSchemeChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || isDigit(c) || c == '+' || c == '-' || c == '.'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
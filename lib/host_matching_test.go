@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"testing"
+)
+
+func assertHostsReplacedWith(t *testing.T, matcher *hostMatcher, original, expected string) {
+	if rewritten, _ := matcher.replaceString(original); rewritten != expected {
+		t.Fatalf("replacement failed, got %s, expected %s", rewritten, expected)
+	}
+}
+
+func TestRemoteHostVariants(t *testing.T) {
+	ctx, err := newMockContext()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matcher := newRemoteHostMatcher(ctx, true)
+
+	assertHostsReplacedWith(t, matcher, "see http://foo.bar/x", "see http://1.2.3.4:8888/x")
+	assertHostsReplacedWith(t, matcher, "HTTPS://bar.baz", "http://4.3.2.1:9999")
+	assertHostsReplacedWith(t, matcher, `var u = "http:\/\/foo.bar\/x";`, `var u = "http:\/\/1.2.3.4:8888\/x";`)
+	assertHostsReplacedWith(t, matcher, "?next=http%3A%2F%2Ffoo.bar%2Fx", "?next=http%3A%2F%2F1.2.3.4%3A8888%2Fx")
+	assertHostsReplacedWith(t, matcher, "?next=http%3a%2f%2ffoo.bar", "?next=http%3a%2f%2f1.2.3.4%3a8888")
+	assertHostsReplacedWith(t, matcher, "?next=http%253A%252F%252Ffoo.bar", "?next=http%253A%252F%252F1.2.3.4%253A8888")
+	assertHostsReplacedWith(t, matcher, `<img src="//foo.bar/x.png">`, `<img src="//1.2.3.4:8888/x.png">`)
+	assertHostsReplacedWith(t, matcher, `{"host":"foo.bar"}`, `{"host":"1.2.3.4:8888"}`)
+	assertHostsReplacedWith(t, matcher, "Welcome to foo.bar.", "Welcome to 1.2.3.4:8888.")
+}
+
+func TestRemoteHostBoundaries(t *testing.T) {
+	ctx, err := newMockContext()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matcher := newRemoteHostMatcher(ctx, true)
+
+	for _, text := range []string{
+		"http://foo.barbaz",
+		"http://foo.bar.baz",
+		"http://foo.bar:8080",
+		"http://x.foo.bar",
+		"https://foo.bar",
+		"ws://foo.bar",
+		"mail@foo.bar",
+		"/path/foo.bar",
+		"%2Ffoo.bar",
+		"http%3A%2F%2Ffoo.bar%3A8080",
+	} {
+		assertHostsReplacedWith(t, matcher, text, text)
+	}
+
+	assertHostsReplacedWith(t, newRemoteHostMatcher(ctx, false), "foo.bar", "foo.bar")
+}
+
+func TestLocalHostVariants(t *testing.T) {
+	ctx, err := newMockContext()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matcher := newLocalHostMatcher(ctx, true)
+
+	assertHostsReplacedWith(t, matcher, "http://1.2.3.4:8888/x", "http://foo.bar/x")
+	assertHostsReplacedWith(t, matcher, "http%3A%2F%2F4.3.2.1%3A9999%2F", "https%3A%2F%2Fbar.baz%2F")
+	assertHostsReplacedWith(t, matcher, "1.2.3.4:8888", "foo.bar")
+	assertHostsReplacedWith(t, matcher, "http://1.2.3.4:88889", "http://1.2.3.4:88889")
+	assertHostsReplacedWith(t, matcher, "http://11.2.3.4:8888", "http://11.2.3.4:8888")
+}
@@ -0,0 +1,291 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+var (
+	htmlUrlAttributes = map[string]bool{
+		"action":     true,
+		"background": true,
+		"cite":       true,
+		"codebase":   true,
+		"data":       true,
+		"formaction": true,
+		"href":       true,
+		"icon":       true,
+		"longdesc":   true,
+		"manifest":   true,
+		"poster":     true,
+		"src":        true,
+		"xlink:href": true,
+	}
+
+	htmlSrcsetAttributes = map[string]bool{
+		"srcset":      true,
+		"imagesrcset": true,
+	}
+
+	metaRefreshPattern = regexp.MustCompile(`(?i)^(\s*\d*\s*[;,]?\s*(?:url\s*=\s*)?["']?)([^"']*)(["']?\s*)$`)
+)
+
+type HtmlRewriter struct {
+	rewriteRoutes []*regexp.Regexp
+}
+
+func (r *HtmlRewriter) Matches(ctx RequestContext) bool {
+	switch responseMediaType(ctx) {
+	case "text/html", "application/xhtml+xml":
+		return matchesRewriteRoutes(r.rewriteRoutes, ctx.RequestUrl())
+	}
+
+	return false
+}
+
+func (r *HtmlRewriter) RewriteResponse(response []byte, ctx RequestContext) []byte {
+	var out bytes.Buffer
+
+	rewritten, err := r.rewrite(bytes.NewReader(response), &out, ctx)
+
+	if !rewritten || err != nil {
+		return response
+	}
+
+	ctx.Log("html rewriter: response rewritten")
+
+	return out.Bytes()
+}
+
+func (r *HtmlRewriter) RewriteResponseStream(response io.Reader, ctx RequestContext) io.Reader {
+	return pipeRewrite(func(out io.Writer) error {
+		buffered := bufio.NewWriter(out)
+
+		rewritten, err := r.rewrite(response, buffered, ctx)
+
+		if rewritten {
+			ctx.Log("html rewriter: response rewritten")
+		}
+
+		if err == nil {
+			err = buffered.Flush()
+		}
+
+		return err
+	})
+}
+
+func (r *HtmlRewriter) rewrite(response io.Reader, out io.Writer, ctx RequestContext) (rewritten bool, err error) {
+	rawTextTag := ""
+
+	tokenizer := html.NewTokenizer(response)
+
+	for {
+		tokenType := tokenizer.Next()
+
+		if tokenType == html.ErrorToken {
+			// Pass on whatever the tokenizer did not consume
+			out.Write(tokenizer.Raw())
+
+			if tokenizer.Err() != io.EOF {
+				err = tokenizer.Err()
+			}
+
+			return
+		}
+
+		// Extracting the token modifies the underlying buffer, so we need a copy
+		raw := append([]byte(nil), tokenizer.Raw()...)
+
+		switch tokenType {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+
+			if r.rewriteTag(&token, ctx) {
+				io.WriteString(out, serializeTag(token))
+				rewritten = true
+			} else {
+				out.Write(raw)
+			}
+
+			if tokenType == html.StartTagToken {
+				rawTextTag = token.Data
+			}
+
+		case html.TextToken:
+			var text []byte
+			changed := false
+
+			// Only script and style contents are rewritten
+			switch rawTextTag {
+			case "style":
+				text, changed = rewriteCss(raw, ctx)
+
+			case "script":
+				text, changed = replaceRemotes(raw, ctx)
+			}
+
+			if changed {
+				out.Write(text)
+				rewritten = true
+			} else {
+				out.Write(raw)
+			}
+
+		case html.CommentToken:
+			// Only IE conditional comments hold markup
+			if !bytes.HasPrefix(raw, []byte("<!--[if")) {
+				out.Write(raw)
+			} else if text, changed := newRemoteHostMatcher(ctx, false).replaceString(string(raw)); changed {
+				io.WriteString(out, text)
+				rewritten = true
+			} else {
+				out.Write(raw)
+			}
+
+		default:
+			rawTextTag = ""
+			out.Write(raw)
+		}
+	}
+}
+
+func (r *HtmlRewriter) rewriteTag(token *html.Token, ctx RequestContext) (rewritten bool) {
+	var fallback *hostMatcher
+
+	for i := range token.Attr {
+		attribute := &token.Attr[i]
+		key := strings.ToLower(attribute.Key)
+
+		value := attribute.Val
+		changed := false
+
+		switch {
+		case htmlUrlAttributes[key]:
+			value, changed = rewriteRemoteUrl(value, ctx)
+
+			// URLs embedded in the query, e.g. of a login link
+			if !changed {
+				value, changed = newRemoteHostMatcher(ctx, false).replaceString(value)
+			}
+
+		case htmlSrcsetAttributes[key]:
+			value, changed = rewriteSrcset(value, ctx)
+
+		case key == "ping":
+			value, changed = rewriteUrlList(value, ctx)
+
+		case key == "style":
+			var style []byte
+			style, changed = rewriteCss([]byte(value), ctx)
+			value = string(style)
+
+		case key == "content" && token.Data == "meta":
+			value, changed = r.rewriteMetaContent(token, value, ctx)
+
+		case strings.HasPrefix(key, "data-") || strings.HasPrefix(key, "on"):
+			// Data attributes and event handlers may hold URLs anywhere
+			if fallback == nil {
+				fallback = newRemoteHostMatcher(ctx, false)
+			}
+
+			value, changed = fallback.replaceString(value)
+		}
+
+		if changed {
+			attribute.Val = value
+			rewritten = true
+		}
+	}
+
+	return
+}
+
+func (r *HtmlRewriter) rewriteMetaContent(token *html.Token, value string, ctx RequestContext) (string, bool) {
+	for _, attribute := range token.Attr {
+		if strings.ToLower(attribute.Key) == "http-equiv" && strings.ToLower(attribute.Val) == "refresh" {
+			match := metaRefreshPattern.FindStringSubmatch(value)
+
+			if match == nil {
+				return value, false
+			}
+
+			if target, ok := rewriteRemoteUrl(match[2], ctx); ok {
+				return match[1] + target + match[3], true
+			}
+
+			return value, false
+		}
+	}
+
+	// Meta tags like og:url carry plain URLs
+	return rewriteRemoteUrl(value, ctx)
+}
+
+func rewriteSrcset(value string, ctx RequestContext) (string, bool) {
+	candidates := strings.Split(value, ",")
+	rewritten := false
+
+	for i, candidate := range candidates {
+		trimmed := strings.TrimLeft(candidate, " \t\n\r\f")
+		leading := candidate[:len(candidate)-len(trimmed)]
+
+		url := trimmed
+		descriptor := ""
+		if end := strings.IndexAny(trimmed, " \t\n\r\f"); end >= 0 {
+			url = trimmed[:end]
+			descriptor = trimmed[end:]
+		}
+
+		if url, ok := rewriteRemoteUrl(url, ctx); ok {
+			candidates[i] = leading + url + descriptor
+			rewritten = true
+		}
+	}
+
+	return strings.Join(candidates, ","), rewritten
+}
+
+func rewriteUrlList(value string, ctx RequestContext) (string, bool) {
+	urls := strings.Split(value, " ")
+	rewritten := false
+
+	for i, url := range urls {
+		if url, ok := rewriteRemoteUrl(url, ctx); ok {
+			urls[i] = url
+			rewritten = true
+		}
+	}
+
+	return strings.Join(urls, " "), rewritten
+}
+
+func serializeTag(token html.Token) string {
+	var out bytes.Buffer
+
+	out.WriteString("<" + token.Data)
+
+	for _, attribute := range token.Attr {
+		out.WriteString(" " + attribute.Key)
+		out.WriteString("=\"" + html.EscapeString(attribute.Val) + "\"")
+	}
+
+	if token.Type == html.SelfClosingTagToken {
+		out.WriteString("/")
+	}
+
+	out.WriteString(">")
+
+	return out.String()
+}
+
+func NewHtmlRewriter(rewriteRoutes []*regexp.Regexp) *HtmlRewriter {
+	return &HtmlRewriter{
+		rewriteRoutes: rewriteRoutes,
+	}
+}
@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"testing"
+)
+
+func assertHtmlRewritesTo(t *testing.T, original, expected string) {
+	ctx, err := newMockContext()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewritten := string(NewHtmlRewriter(nil).RewriteResponse([]byte(original), ctx))
+
+	if rewritten != expected {
+		t.Fatalf("rewrite failed, got %s, expected %s", rewritten, expected)
+	}
+}
+
+func TestHtmlAttributes(t *testing.T) {
+	assertHtmlRewritesTo(t,
+		`<p><a class="x" href="http://foo.bar/x">http://foo.bar/y</a><form action="https://bar.baz/post"></form></p>`,
+		`<p><a class="x" href="http://1.2.3.4:8888/x">http://foo.bar/y</a><form action="http://4.3.2.1:9999/post"></form></p>`)
+}
+
+func TestHtmlEntities(t *testing.T) {
+	assertHtmlRewritesTo(t,
+		`<a href="http&#x3a;&#x2f;&#x2f;foo.bar/x?a=1&amp;b=2">link</a>`,
+		`<a href="http://1.2.3.4:8888/x?a=1&amp;b=2">link</a>`)
+}
+
+func TestHtmlSchemeRelative(t *testing.T) {
+	assertHtmlRewritesTo(t,
+		`<img src="//foo.bar/i.png"/>`,
+		`<img src="http://1.2.3.4:8888/i.png"/>`)
+}
+
+func TestHtmlSrcset(t *testing.T) {
+	assertHtmlRewritesTo(t,
+		`<img srcset="http://foo.bar/a.png 1x, https://bar.baz/b.png 2x,/c.png 3x">`,
+		`<img srcset="http://1.2.3.4:8888/a.png 1x, http://4.3.2.1:9999/b.png 2x,/c.png 3x">`)
+}
+
+func TestHtmlMetaRefresh(t *testing.T) {
+	assertHtmlRewritesTo(t,
+		`<meta http-equiv="Refresh" content="5; URL='http://foo.bar/next'">`,
+		`<meta http-equiv="Refresh" content="5; URL=&#39;http://1.2.3.4:8888/next&#39;">`)
+
+	assertHtmlRewritesTo(t,
+		`<meta name="description" content="see http://foo.bar">`,
+		`<meta name="description" content="see http://foo.bar">`)
+}
+
+func TestHtmlBaseAndStyles(t *testing.T) {
+	assertHtmlRewritesTo(t,
+		`<base href="http://foo.bar/"><style>body { background: url("http://foo.bar/bg.png") }</style><div style="background: url(https://bar.baz/x.png)"></div>`,
+		`<base href="http://1.2.3.4:8888/"><style>body { background: url("http://1.2.3.4:8888/bg.png") }</style><div style="background: url(http://4.3.2.1:9999/x.png)"></div>`)
+}
+
+func TestHtmlHostBoundary(t *testing.T) {
+	assertHtmlRewritesTo(t,
+		`<a href="http://foo.barbaz/x">link</a>`,
+		`<a href="http://foo.barbaz/x">link</a>`)
+}
+
+func TestHtmlFallback(t *testing.T) {
+	assertHtmlRewritesTo(t,
+		`<img data-src="http://foo.bar/i.png" data-config='{"api":"https://bar.baz/v1"}' onclick="go('http://foo.bar/x')"><!--[if IE]><script src="http://foo.bar/ie.js"></script><![endif]-->`,
+		`<img data-src="http://1.2.3.4:8888/i.png" data-config="{&#34;api&#34;:&#34;http://4.3.2.1:9999/v1&#34;}" onclick="go(&#39;http://1.2.3.4:8888/x&#39;)"><!--[if IE]><script src="http://1.2.3.4:8888/ie.js"></script><![endif]-->`)
+
+	// Text that only looks like a host is left alone
+	unchanged := `<img alt="foo.bar logo" title="see http://foo.bar/" data-name="foo.bar"><!-- http://foo.bar/old -->`
+	assertHtmlRewritesTo(t, unchanged, unchanged)
+}
@@ -0,0 +1,174 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newIncomingBodyProxy(t *testing.T, received chan<- *http.Request, bodies chan<- []byte) (proxy *httptest.Server, upstream *httptest.Server) {
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		received <- r
+		bodies <- body
+	}))
+
+	proxy = httptest.NewUnstartedServer(nil)
+
+	local, _ := NewMapping(proxy.Listener.Addr().String(), upstream.URL)
+	foo, _ := NewMapping("10.0.2.2:8081", "http://foo.bar")
+
+	p, err := NewProxyServer(local, []Mapping{local, foo}, ioutil.Discard, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := NewConfig()
+	config.AddRewriteRoute(".")
+	p.AddRewriter(NewJsonRewriter(config.rewriteRoutes))
+	p.AddRewriter(NewFormRewriter(config.rewriteRoutes))
+	p.AddRewriter(NewMultipartRewriter(config.rewriteRoutes))
+
+	proxy.Config.Handler = p
+	proxy.Start()
+
+	return
+}
+
+func TestIncomingJsonBody(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+
+	proxy, upstream := newIncomingBodyProxy(t, received, bodies)
+	defer upstream.Close()
+	defer proxy.Close()
+
+	_, err := http.Post(proxy.URL+"/api", "application/json",
+		strings.NewReader(`{"callback":"http://10.0.2.2:8081/return","other":"http://10.0.2.2:8081x"}`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, body := <-received, <-bodies
+
+	expected := `{"callback":"http://foo.bar/return","other":"http://10.0.2.2:8081x"}`
+
+	if string(body) != expected {
+		t.Fatalf("unexpected body %s", body)
+	}
+
+	if request.ContentLength != int64(len(expected)) {
+		t.Fatalf("unexpected content length %d", request.ContentLength)
+	}
+}
+
+func TestIncomingJsonBodyVerbatim(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+
+	proxy, upstream := newIncomingBodyProxy(t, received, bodies)
+	defer upstream.Close()
+	defer proxy.Close()
+
+	_, err := http.Post(proxy.URL+"/api", "application/json",
+		strings.NewReader(`{"z": 12345678901234567891, "html": "<b>&amp;</b>", "escaped": "\u00e9", "a": ["http:\/\/10.0.2.2:8081\/x"]}`))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-received
+
+	// Only the string containing the URL changes
+	expected := `{"z": 12345678901234567891, "html": "<b>&amp;</b>", "escaped": "\u00e9", "a": ["http://foo.bar/x"]}`
+
+	if body := <-bodies; string(body) != expected {
+		t.Fatalf("unexpected body %s", body)
+	}
+}
+
+func TestIncomingFormBody(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+
+	proxy, upstream := newIncomingBodyProxy(t, received, bodies)
+	defer upstream.Close()
+	defer proxy.Close()
+
+	form := "b=1&redirect_uri=http%3A%2F%2F10.0.2.2%3A8081%2Freturn%3Fa%3Db&flag&a=%7E"
+
+	_, err := http.Post(proxy.URL+"/login", "application/x-www-form-urlencoded", strings.NewReader(form))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, body := <-received, <-bodies
+
+	expected := "b=1&redirect_uri=" + url.QueryEscape("http://foo.bar/return?a=b") + "&flag&a=%7E"
+
+	if string(body) != expected {
+		t.Fatalf("unexpected body %s, expected %s", body, expected)
+	}
+
+	if request.ContentLength != int64(len(expected)) {
+		t.Fatalf("unexpected content length %d", request.ContentLength)
+	}
+}
+
+func TestIncomingMultipartBody(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+
+	proxy, upstream := newIncomingBodyProxy(t, received, bodies)
+	defer upstream.Close()
+	defer proxy.Close()
+
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+
+	writer.WriteField("callback", "http://10.0.2.2:8081/return")
+	file, _ := writer.CreateFormFile("upload", "image.png")
+	file.Write([]byte("\x89PNG http://10.0.2.2:8081/"))
+	writer.Close()
+
+	_, err := http.Post(proxy.URL+"/upload", writer.FormDataContentType(), &buffer)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, body := <-received, <-bodies
+
+	if request.ContentLength != int64(len(body)) {
+		t.Fatalf("content length %d does not match body length %d", request.ContentLength, len(body))
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(body), writer.Boundary())
+
+	part, err := reader.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := ioutil.ReadAll(part); string(value) != "http://foo.bar/return" {
+		t.Fatalf("field not rewritten, got %s", value)
+	}
+
+	part, err = reader.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := ioutil.ReadAll(part); string(value) != "\x89PNG http://10.0.2.2:8081/" {
+		t.Fatalf("binary upload modified, got %q", value)
+	}
+}
@@ -1,9 +1,9 @@
 package lib
 
 import (
+	"bytes"
 	"encoding/json"
 	"regexp"
-	"strings"
 )
 
 type JsonRewriter struct {
@@ -12,36 +12,63 @@ type JsonRewriter struct {
 
 func (r *JsonRewriter) Matches(ctx RequestContext) bool {
 	request := ctx.IncomingRequest()
-	response := ctx.UpstreamResponse()
 
-	if response.Header.Get("content-type") != "application/json" {
+	if responseMediaType(ctx) != "application/json" {
 		return false
 	}
 
-	for _, route := range r.rewriteRoutes {
-		if route.MatchString(request.RequestURI) {
-			return true
-		}
+	return matchesRewriteRoutes(r.rewriteRoutes, request.RequestURI)
+}
+
+func (r *JsonRewriter) RewriteResponse(response []byte, ctx RequestContext) []byte {
+	matcher := newRemoteHostMatcher(ctx, true)
+
+	filteredResponse, rewritten := rewriteJson(response, func(in string, rewritten *bool) string {
+		return r.stringReplace(in, matcher, rewritten)
+	})
+
+	if rewritten {
+		ctx.Log("json rewriter: response rewritten")
 	}
 
-	return false
+	return filteredResponse
 }
 
-func (r *JsonRewriter) RewriteResponse(response []byte, ctx RequestContext) []byte {
-	var err error
+func (r *JsonRewriter) MatchesIncoming(ctx RequestContext) bool {
+	if requestMediaType(ctx) != "application/json" {
+		return false
+	}
 
-	rewritten := false
+	return matchesRewriteRoutes(r.rewriteRoutes, ctx.IncomingRequest().RequestURI)
+}
+
+func (r *JsonRewriter) RewriteIncomingBody(body []byte, ctx RequestContext) []byte {
+	matcher := newLocalHostMatcher(ctx, true)
+
+	filteredBody, rewritten := rewriteJsonStrings(body, func(in string, rewritten *bool) string {
+		return r.stringReplace(in, matcher, rewritten)
+	})
+
+	if rewritten {
+		ctx.Log("json rewriter: request rewritten")
+	}
+
+	return filteredBody
+}
+
+func rewriteJson(data []byte, replace func(string, *bool) string) (result []byte, rewritten bool) {
+	var err error
 
 	stack := make([]interface{}, 0, 50)
 
 	var unmarshalledResponse interface{}
-	err = json.Unmarshal(response, &unmarshalledResponse)
+	err = json.Unmarshal(data, &unmarshalledResponse)
 	if err != nil {
-		return response
+		return data, false
 	}
 
 	if responseString, ok := unmarshalledResponse.(string); ok {
-		unmarshalledResponse = r.stringReplace(responseString, ctx, &rewritten)
+		unmarshalledResponse = replace(responseString, &rewritten)
 	} else {
 		stack = append(stack, unmarshalledResponse)
 	}
@@ -55,7 +82,7 @@ func (r *JsonRewriter) RewriteResponse(response []byte, ctx RequestContext) []by
 			for i, value := range elt {
 				switch value := value.(type) {
 				case string:
-					elt[i] = r.stringReplace(value, ctx, &rewritten)
+					elt[i] = replace(value, &rewritten)
 
 				case []interface{}:
 					stack = append(stack, value)
@@ -69,7 +96,7 @@ func (r *JsonRewriter) RewriteResponse(response []byte, ctx RequestContext) []by
 			for key, value := range elt {
 
 				rewriteKey := false
-				newKey := r.stringReplace(key, ctx, &rewriteKey)
+				newKey := replace(key, &rewriteKey)
 
 				if _, ok := elt[newKey]; ok {
 					rewriteKey = false
@@ -84,7 +111,7 @@ func (r *JsonRewriter) RewriteResponse(response []byte, ctx RequestContext) []by
 
 				switch value := value.(type) {
 				case string:
-					elt[newKey] = r.stringReplace(value, ctx, &rewritten)
+					elt[newKey] = replace(value, &rewritten)
 
 				case []interface{}:
 					stack = append(stack, value)
@@ -103,19 +130,80 @@ func (r *JsonRewriter) RewriteResponse(response []byte, ctx RequestContext) []by
 	}
 
 	if filteredResponse != nil && err == nil {
-		ctx.Log("json rewriter: response rewritten")
-		return filteredResponse
+		return filteredResponse, true
 	} else {
-		return response
+		return data, false
 	}
 }
 
-func (*JsonRewriter) stringReplace(in string, ctx RequestContext, rewritten *bool) string {
-	for _, mapping := range ctx.HostMappings() {
-		if strings.Contains(in, mapping.remote) {
-			in = strings.Replace(in, mapping.remote, mapping.local, -1)
-			*rewritten = true
+// Rewrites the strings of a JSON document in place. Numbers, key order and
+// escaping stay exactly as sent, as the upstream may verify or sign the body.
+func rewriteJsonStrings(data []byte, replace func(string, *bool) string) (result []byte, rewritten bool) {
+	// In valid JSON, quotes outside of strings only start a string
+	if !json.Valid(data) {
+		return data, false
+	}
+
+	result = make([]byte, 0, len(data))
+	last := 0
+
+	for start := 0; start < len(data); start++ {
+		if data[start] != '"' {
+			continue
+		}
+
+		end := start + 1
+		for data[end] != '"' {
+			if data[end] == '\\' {
+				end++
+			}
+
+			end++
+		}
+
+		var value string
+		json.Unmarshal(data[start:end+1], &value)
+
+		changed := false
+		value = replace(value, &changed)
+
+		if changed {
+			if encoded, err := marshalJson(value); err == nil {
+				result = append(append(result, data[last:start]...), encoded...)
+				last = end + 1
+				rewritten = true
+			}
 		}
+
+		start = end
+	}
+
+	if !rewritten {
+		return data, false
+	}
+
+	return append(result, data[last:]...), true
+}
+
+// Unlike json.Marshal, this keeps <, > and & as they are
+func marshalJson(value interface{}) ([]byte, error) {
+	var out bytes.Buffer
+
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimRight(out.Bytes(), "\n"), nil
+}
+
+func (*JsonRewriter) stringReplace(in string, matcher *hostMatcher, rewritten *bool) string {
+	in, ok := matcher.replaceString(in)
+
+	if ok {
+		*rewritten = true
 	}
 
 	return in
@@ -0,0 +1,139 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func waitForListener(t *testing.T, address string, listening bool) {
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", address)
+
+		if err == nil {
+			conn.Close()
+		}
+
+		if (err == nil) == listening {
+			return
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatalf("listener on %s did not change its state", address)
+}
+
+func TestReproRun(t *testing.T) {
+	started := make(chan bool)
+	release := make(chan bool)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+		fmt.Fprint(w, "done")
+	}))
+	defer upstream.Close()
+
+	local := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+
+	cfg := NewConfig()
+	cfg.SetLog(ioutil.Discard)
+	cfg.AddMapping(local, upstream.URL)
+
+	r, err := NewRepro(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stopped := make(chan error)
+	go func() {
+		stopped <- r.Run(ctx, 5*time.Second)
+	}()
+
+	waitForListener(t, local, true)
+
+	responses := make(chan string)
+	go func() {
+		response, err := http.Get("http://" + local + "/")
+
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		responses <- string(body)
+	}()
+
+	<-started
+	cancel()
+
+	// New connections are refused while the active request drains
+	waitForListener(t, local, false)
+
+	if state := r.proxies[0].State(); state != proxyStopping {
+		t.Fatalf("unexpected state %s", state)
+	}
+
+	close(release)
+
+	if body := <-responses; body != "done" {
+		t.Fatalf("active request failed: %s", body)
+	}
+
+	if err = <-stopped; err != nil {
+		t.Fatal(err)
+	}
+
+	if state := r.proxies[0].State(); state != proxyStopped {
+		t.Fatalf("unexpected state %s", state)
+	}
+}
+
+func TestMappingError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	cfg := NewConfig()
+	cfg.SetLog(ioutil.Discard)
+	cfg.AddMapping(listener.Addr().String(), "http://busy.test")
+
+	r, err := NewRepro(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.Run(context.Background(), time.Second)
+
+	var mappingError *MappingError
+
+	if !errors.As(err, &mappingError) {
+		t.Fatalf("expected a mapping error, got %v", err)
+	}
+
+	if mappingError.Local != "http://"+listener.Addr().String() || mappingError.Remote != "http://busy.test" {
+		t.Fatalf("unexpected mapping in %v", err)
+	}
+
+	if r.proxies[0].State() != proxyFailed {
+		t.Fatalf("unexpected state %s", r.proxies[0].State())
+	}
+}
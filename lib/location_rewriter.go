@@ -11,6 +11,12 @@ type LocationRewriter struct {
 func (l *LocationRewriter) RewriteHeaders(headers http.Header, ctx RequestContext) {
 	if l.GenericHeaderRewriter.RewriteSpecifiedHeaders([]string{"location"}, headers, ctx) {
 		ctx.Log("rewrote location")
+		return
+	}
+
+	if location, ok := rewriteRootRelativeUrl(headers.Get("location"), ctx); ok {
+		headers.Set("location", location)
+		ctx.Log("rewrote location")
 	}
 }
 
@@ -4,11 +4,15 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"strings"
 )
 
 type Mapping struct {
-	local  string
-	remote string
+	local       string
+	remote      string
+	localTLS    bool
+	options     *MappingOptions
+	virtualHost string
 }
 
 func NewMapping(local, remote string) (m Mapping, err error) {
@@ -22,9 +26,35 @@ func NewMapping(local, remote string) (m Mapping, err error) {
 		return
 	}
 
+	local, localTLS, err := parseLocal(local)
+
+	if err != nil {
+		return
+	}
+
 	m = Mapping{
-		local:  local,
-		remote: remote,
+		local:    local,
+		remote:   remote,
+		localTLS: localTLS,
+	}
+
+	return
+}
+
+func parseLocal(local string) (address string, localTLS bool, err error) {
+	address = local
+
+	switch {
+	case strings.HasPrefix(local, "https://"):
+		address = local[len("https://"):]
+		localTLS = true
+
+	case strings.HasPrefix(local, "http://"):
+		address = local[len("http://"):]
+	}
+
+	if strings.Contains(address, "/") {
+		err = errors.New(fmt.Sprintf("%s: local address must not have a path", local))
 	}
 
 	return
@@ -33,15 +63,91 @@ func NewMapping(local, remote string) (m Mapping, err error) {
 func validateRemote(remote string) (err error) {
 	u, err := url.Parse(remote)
 
+	if err != nil {
+		return
+	}
+
 	if u.Scheme == "" {
 		err = errors.New(fmt.Sprintf("%s: missing scheme", remote))
-	} else if u.Scheme != "http" && u.Scheme != "https" {
+	} else if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "ws" && u.Scheme != "wss" {
 		err = errors.New(fmt.Sprintf("%s: unsupported scheme", remote))
 	}
 
-	if u.Path != "" {
-		err = errors.New(fmt.Sprintf("%s: must not have a nontrivial path", remote))
+	if u.RawQuery != "" || u.Fragment != "" {
+		err = errors.New(fmt.Sprintf("%s: must not have a query or fragment", remote))
 	}
 
 	return
 }
+
+// The path prefix under which an application is mounted, without trailing
+// slash
+func urlPathPrefix(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimRight(u.EscapedPath(), "/")
+}
+
+// The host name of the remote, without port
+func (m *Mapping) remoteHostname() string {
+	u, err := url.Parse(m.remote)
+
+	if err != nil {
+		return ""
+	}
+
+	return strings.ToLower(u.Hostname())
+}
+
+// The path prefix under which a mapping is served if virtual hosts are
+// distinguished by path, e.g. /_/foo.bar.dev/shop
+func (m *Mapping) virtualHostPath() string {
+	if m.virtualHost != VirtualHostByPath {
+		return ""
+	}
+
+	u, err := url.Parse(m.remote)
+
+	if err != nil {
+		return ""
+	}
+
+	return virtualHostPathPrefix + strings.ToLower(u.Host) + urlPathPrefix(m.remote)
+}
+
+// The scheme under which the local side of the mapping is reachable
+func (m *Mapping) localScheme() string {
+	switch {
+	case isWebsocketUrl(m.remote) && m.localTLS:
+		return "wss"
+
+	case isWebsocketUrl(m.remote):
+		return "ws"
+
+	case m.localTLS:
+		return "https"
+	}
+
+	return "http"
+}
+
+func isWebsocketUrl(url string) bool {
+	return strings.HasPrefix(url, "ws://") || strings.HasPrefix(url, "wss://")
+}
+
+// Websocket endpoints are accessed via HTTP for everything but the upgrade
+func httpUrl(url string) string {
+	switch {
+	case strings.HasPrefix(url, "ws://"):
+		return "http://" + url[len("ws://"):]
+
+	case strings.HasPrefix(url, "wss://"):
+		return "https://" + url[len("wss://"):]
+	}
+
+	return url
+}
@@ -0,0 +1,172 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Settings of a single mapping that override the global configuration. Unset
+// options fall back to the global defaults.
+type MappingOptions struct {
+	rewriteRoutes          []*regexp.Regexp
+	overrideRewriteRoutes  bool
+	sslAllowInsecure       *bool
+	noLogging              *bool
+	timeout                time.Duration
+	requestHeaders         http.Header
+	rewriteHeaders         []string
+	rewriteIncomingHeaders []string
+	rewriters              []string
+	overrideRewriters      bool
+}
+
+// The effective settings of a mapping
+type proxySettings struct {
+	rewriteRoutes          []*regexp.Regexp
+	sslAllowInsecure       bool
+	noLogging              bool
+	timeout                time.Duration
+	requestHeaders         http.Header
+	rewriteHeaders         []string
+	rewriteIncomingHeaders []string
+	rewriters              map[string]bool
+}
+
+func NewMappingOptions() *MappingOptions {
+	return &MappingOptions{
+		requestHeaders: make(http.Header),
+	}
+}
+
+func (o *MappingOptions) AddRewriteRoute(pattern string) (err error) {
+	r, err := regexp.Compile(pattern)
+
+	if err == nil {
+		o.rewriteRoutes = append(o.rewriteRoutes, r)
+		o.overrideRewriteRoutes = true
+	}
+
+	return
+}
+
+// Disables body rewriting for the mapping, regardless of the global routes
+func (o *MappingOptions) ClearRewriteRoutes() {
+	o.rewriteRoutes = nil
+	o.overrideRewriteRoutes = true
+}
+
+func (o *MappingOptions) SetSSLAllowInsecure(flag bool) {
+	o.sslAllowInsecure = &flag
+}
+
+func (o *MappingOptions) SetNoLogging(flag bool) {
+	o.noLogging = &flag
+}
+
+func (o *MappingOptions) SetTimeout(timeout time.Duration) {
+	o.timeout = timeout
+}
+
+// Headers set on all requests sent upstream
+func (o *MappingOptions) AddRequestHeader(key, value string) {
+	if o.requestHeaders == nil {
+		o.requestHeaders = make(http.Header)
+	}
+
+	o.requestHeaders.Add(key, value)
+}
+
+func (o *MappingOptions) AddRewriteHeader(header string) {
+	o.rewriteHeaders = append(o.rewriteHeaders, strings.ToLower(header))
+}
+
+func (o *MappingOptions) AddRewriteIncomingHeader(header string) {
+	o.rewriteIncomingHeaders = append(o.rewriteIncomingHeaders, strings.ToLower(header))
+}
+
+// Restricts the mapping to the given rewriters. By default, all rewriters are
+// enabled.
+func (o *MappingOptions) EnableRewriter(name string) (err error) {
+	name = strings.ToLower(name)
+
+	for _, known := range RewriterNames {
+		if name == known {
+			o.rewriters = append(o.rewriters, name)
+			o.overrideRewriters = true
+			return
+		}
+	}
+
+	return errors.New(fmt.Sprintf("unknown rewriter: %s", name))
+}
+
+// Disables all rewriters for the mapping unless enabled explicitly
+func (o *MappingOptions) ClearRewriters() {
+	o.rewriters = nil
+	o.overrideRewriters = true
+}
+
+func (c *Config) AddMappingWithOptions(local, remote string, options *MappingOptions) (err error) {
+	m, err := NewMapping(local, remote)
+
+	if err == nil {
+		m.options = options
+		c.mappings = append(c.mappings, m)
+	}
+
+	return
+}
+
+func (c *Config) proxySettings(m Mapping) (s proxySettings) {
+	s = proxySettings{
+		rewriteRoutes:          c.rewriteRoutes,
+		sslAllowInsecure:       c.sslAllowInsecure,
+		noLogging:              c.noLogging,
+		requestHeaders:         make(http.Header),
+		rewriteHeaders:         c.rewriteHeaders,
+		rewriteIncomingHeaders: c.rewriteIncomingHeaders,
+	}
+
+	o := m.options
+
+	if o == nil {
+		return
+	}
+
+	if o.overrideRewriteRoutes {
+		s.rewriteRoutes = o.rewriteRoutes
+	}
+
+	if o.sslAllowInsecure != nil {
+		s.sslAllowInsecure = *o.sslAllowInsecure
+	}
+
+	if o.noLogging != nil {
+		s.noLogging = *o.noLogging
+	}
+
+	s.timeout = o.timeout
+	s.requestHeaders = o.requestHeaders
+
+	// Headers add to the global ones
+	s.rewriteHeaders = append(append([]string(nil), c.rewriteHeaders...), o.rewriteHeaders...)
+	s.rewriteIncomingHeaders = append(append([]string(nil), c.rewriteIncomingHeaders...), o.rewriteIncomingHeaders...)
+
+	if o.overrideRewriters {
+		s.rewriters = make(map[string]bool)
+
+		for _, name := range o.rewriters {
+			s.rewriters[name] = true
+		}
+	}
+
+	return
+}
+
+func (s *proxySettings) enables(rewriter string) bool {
+	return s.rewriters == nil || s.rewriters[rewriter]
+}
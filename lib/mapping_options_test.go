@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMappingOptionsOverrideDefaults(t *testing.T) {
+	cfg := NewConfig()
+	cfg.SetLog(ioutil.Discard)
+	cfg.SetNoLogging(true)
+	cfg.AddRewriteRoute("global")
+	cfg.AddRewriteHeader("link")
+
+	options := NewMappingOptions()
+	options.AddRewriteRoute("local")
+	options.SetNoLogging(false)
+	options.SetSSLAllowInsecure(true)
+	options.SetTimeout(5 * time.Second)
+	options.AddRequestHeader("authorization", "Bearer abc")
+	options.AddRewriteHeader("x-callback-url")
+
+	if err := options.EnableRewriter("location"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := options.EnableRewriter("json"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := options.EnableRewriter("unknown"); err == nil {
+		t.Fatal("unknown rewriter accepted")
+	}
+
+	cfg.AddMapping("127.0.0.1:8080", "http://foo.bar")
+	cfg.AddMappingWithOptions("127.0.0.1:8081", "http://bar.baz", options)
+
+	defaults := cfg.proxySettings(cfg.mappings[0])
+	overridden := cfg.proxySettings(cfg.mappings[1])
+
+	if !defaults.noLogging || defaults.sslAllowInsecure || len(defaults.rewriteRoutes) != 1 || !defaults.enables("html") {
+		t.Fatalf("unexpected default settings %v", defaults)
+	}
+
+	if overridden.noLogging || !overridden.sslAllowInsecure || overridden.timeout != 5*time.Second {
+		t.Fatalf("unexpected overridden settings %v", overridden)
+	}
+
+	if len(overridden.rewriteRoutes) != 1 || overridden.rewriteRoutes[0].String() != "local" {
+		t.Fatalf("rewrite routes not overridden: %v", overridden.rewriteRoutes)
+	}
+
+	if len(overridden.rewriteHeaders) != 2 || overridden.requestHeaders.Get("authorization") != "Bearer abc" {
+		t.Fatalf("unexpected headers %v %v", overridden.rewriteHeaders, overridden.requestHeaders)
+	}
+
+	r, err := NewRepro(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.proxies[0].rewriters) != len(RewriterNames) {
+		t.Fatalf("expected all rewriters for the default mapping, got %d", len(r.proxies[0].rewriters))
+	}
+
+	if len(r.proxies[1].rewriters) != 2 {
+		t.Fatalf("expected two rewriters, got %d", len(r.proxies[1].rewriters))
+	}
+
+	if _, ok := r.proxies[1].rewriters[1].(*JsonRewriter); !ok {
+		t.Fatal("json rewriter missing")
+	}
+
+	if r.proxies[1].noLogging || !r.proxies[0].noLogging {
+		t.Fatal("logging settings not applied")
+	}
+}
+
+func TestMappingWithoutCookieRewriter(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("set-cookie", "id=1; Domain=.foo.bar; Path=/")
+		w.Header().Add("set-cookie", "other=2;domain=foo.bar")
+	}))
+	defer upstream.Close()
+
+	cfg := NewConfig()
+	cfg.SetLog(ioutil.Discard)
+
+	options := NewMappingOptions()
+	options.EnableRewriter("location")
+
+	cfg.AddMappingWithOptions("127.0.0.1:8080", upstream.URL, options)
+
+	r, err := NewRepro(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := httptest.NewServer(r.proxies[0])
+	defer proxy.Close()
+
+	response, err := http.Get(proxy.URL + "/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response.Body.Close()
+
+	if cookies := response.Header["Set-Cookie"]; len(cookies) != 2 || cookies[0] != "id=1; Path=/" || cookies[1] != "other=2" {
+		t.Fatalf("cookie domains not removed: %v", cookies)
+	}
+}
+
+func TestClearRewriters(t *testing.T) {
+	cfg := NewConfig()
+	cfg.SetLog(ioutil.Discard)
+
+	options := NewMappingOptions()
+	options.ClearRewriters()
+
+	cfg.AddMappingWithOptions("127.0.0.1:8080", "http://foo.bar", options)
+
+	if settings := cfg.proxySettings(cfg.mappings[0]); settings.enables("location") || settings.enables("html") {
+		t.Fatal("rewriters not disabled")
+	}
+
+	r, err := NewRepro(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.proxies[0].rewriters) != 0 {
+		t.Fatalf("expected no rewriters, got %d", len(r.proxies[0].rewriters))
+	}
+}
@@ -0,0 +1,185 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// The mappings shared by all proxies. Remotes matching a wildcard mapping or
+// the discovery allowlist are added at runtime, so access is synchronized.
+type mappingRegistry struct {
+	mutex     sync.RWMutex
+	mappings  []Mapping
+	wildcards []WildcardMapping
+	discovery *hostDiscovery
+
+	// Starts serving a mapping on a port from the range
+	allocate func(ports *portRange, remote string) (Mapping, error)
+}
+
+func newMappingRegistry(mappings []Mapping) *mappingRegistry {
+	return &mappingRegistry{
+		mappings: mappings,
+	}
+}
+
+func (r *mappingRegistry) Mappings() []Mapping {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.mappings
+}
+
+func (r *mappingRegistry) Wildcards() []WildcardMapping {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.wildcards
+}
+
+func (r *mappingRegistry) Discovers() bool {
+	return r.discovery != nil
+}
+
+func (r *mappingRegistry) DiscoveredHosts() []DiscoveredHost {
+	if r.discovery == nil {
+		return nil
+	}
+
+	return r.discovery.snapshot()
+}
+
+func (r *mappingRegistry) find(remote string) (m Mapping, ok bool) {
+	for _, m = range r.mappings {
+		if strings.EqualFold(m.remote, remote) {
+			return m, true
+		}
+	}
+
+	return
+}
+
+// Remotes with a path prefix cover their origin, too
+func (r *mappingRegistry) coversOrigin(remote string) bool {
+	origin := parseOrigin(remote)
+
+	for _, m := range r.mappings {
+		o := parseOrigin(m.remote)
+
+		if o.scheme == origin.scheme && strings.EqualFold(o.host, origin.host) && o.port == origin.port {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the mapping for an origin, allocating a new one if it matches a
+// wildcard or the discovery allowlist. The referrer is the URL of the response
+// that refers to the origin. Only allocations take the write lock, as most
+// unmapped origins are merely recorded.
+func (r *mappingRegistry) resolve(remote, referrer string) (m Mapping, ok bool) {
+	remote = strings.ToLower(remote)
+
+	r.mutex.RLock()
+	m, ok = r.find(remote)
+	covered := ok || r.coversOrigin(remote)
+	ports := r.wildcardPorts(remote)
+	r.mutex.RUnlock()
+
+	if covered || r.allocate == nil {
+		return
+	}
+
+	if ports == nil && r.discovery != nil {
+		ports = r.discovery.record(remote, referrer)
+	}
+
+	if ports == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Another request may have been faster
+	if m, ok = r.find(remote); ok || r.coversOrigin(remote) {
+		return
+	}
+
+	m, err := r.allocate(ports, remote)
+
+	if err != nil {
+		return m, false
+	}
+
+	r.add(m)
+
+	if r.discovery != nil {
+		r.discovery.markMapped(remote)
+	}
+
+	return m, true
+}
+
+// The caller holds the lock
+func (r *mappingRegistry) wildcardPorts(remote string) *portRange {
+	for i := range r.wildcards {
+		if r.wildcards[i].matches(remote) {
+			return &r.wildcards[i].ports
+		}
+	}
+
+	return nil
+}
+
+// Readers may still hold the old slice, so it is never modified in place. The
+// caller holds the lock.
+func (r *mappingRegistry) add(m Mapping) {
+	r.mappings = append(r.mappings[:len(r.mappings):len(r.mappings)], m)
+}
+
+// The remote is only needed if several mappings share the local address
+func (r *mappingRegistry) remove(local, remote string) (m Mapping, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	remote = strings.TrimRight(remote, "/")
+	match := -1
+
+	for i, candidate := range r.mappings {
+		if candidate.local != local || remote != "" && !strings.EqualFold(candidate.remote, remote) {
+			continue
+		}
+
+		if match >= 0 {
+			err = errors.New(fmt.Sprintf("%s: address is shared by several mappings, the remote is required", local))
+			return
+		}
+
+		match = i
+	}
+
+	if match < 0 {
+		err = errors.New(fmt.Sprintf("%s: no such mapping", local))
+		return
+	}
+
+	m = r.mappings[match]
+	r.mappings = append(r.mappings[:match:match], r.mappings[match+1:]...)
+
+	return
+}
+
+// Checks whether a local address is taken. The caller holds the lock.
+func (r *mappingRegistry) usesLocal(local string) bool {
+	for _, m := range r.mappings {
+		if m.local == local {
+			return true
+		}
+	}
+
+	return false
+}
@@ -32,10 +32,42 @@ func TestTrailingSlash(t *testing.T) {
 	}
 }
 
-func TestNontrivialPath(t *testing.T) {
-	_, err := NewMapping("0.0.0.0:8080", "http://foo.bar.com/baz")
+func TestPathPrefix(t *testing.T) {
+	m, err := NewMapping("0.0.0.0:8080", "http://foo.bar.com/baz/")
+
+	if err != nil {
+		t.Fatalf("instantiation failed: %v", err)
+	}
+
+	if m.remote != "http://foo.bar.com/baz" {
+		t.Fatalf("unexpected remote %s", m.remote)
+	}
+
+	_, err = NewMapping("0.0.0.0:8080", "http://foo.bar.com/baz?x=y")
 
 	if err == nil {
-		t.Fatal("nontrivial path should be an error")
+		t.Fatal("query should be an error")
+	}
+}
+
+func TestLocalTLSPrefix(t *testing.T) {
+	m, err := NewMapping("https://0.0.0.0:8443", "http://foo.bar.com")
+
+	if err != nil {
+		t.Fatalf("instantiation failed: %v", err)
+	}
+
+	if m.local != "0.0.0.0:8443" || !m.localTLS {
+		t.Fatalf("https prefix should enable local TLS, got %v", m)
+	}
+
+	m, err = NewMapping("http://0.0.0.0:8080", "http://foo.bar.com")
+
+	if err != nil {
+		t.Fatalf("instantiation failed: %v", err)
+	}
+
+	if m.local != "0.0.0.0:8080" || m.localTLS {
+		t.Fatalf("http prefix should be stripped, got %v", m)
 	}
 }
@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"regexp"
+	"strings"
+)
+
+type MultipartRewriter struct {
+	rewriteRoutes []*regexp.Regexp
+}
+
+func (r *MultipartRewriter) MatchesIncoming(ctx RequestContext) bool {
+	if requestMediaType(ctx) != "multipart/form-data" {
+		return false
+	}
+
+	return matchesRewriteRoutes(r.rewriteRoutes, ctx.IncomingRequest().RequestURI)
+}
+
+func (r *MultipartRewriter) RewriteIncomingBody(body []byte, ctx RequestContext) []byte {
+	_, params, err := mime.ParseMediaType(ctx.IncomingRequest().Header.Get("content-type"))
+
+	if err != nil || params["boundary"] == "" {
+		return body
+	}
+
+	var out bytes.Buffer
+
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	writer := multipart.NewWriter(&out)
+	rewritten := false
+
+	if err = writer.SetBoundary(params["boundary"]); err != nil {
+		return body
+	}
+
+	for {
+		// Raw parts, we do not want to touch transfer encodings
+		part, e := reader.NextRawPart()
+
+		if e == io.EOF {
+			break
+		}
+
+		if e != nil {
+			return body
+		}
+
+		data, e := ioutil.ReadAll(part)
+		if e != nil {
+			return body
+		}
+
+		if isTextPart(part) {
+			var ok bool
+			if data, ok = replaceLocals(data, ctx); ok {
+				rewritten = true
+			}
+		}
+
+		partWriter, e := writer.CreatePart(part.Header)
+		if e == nil {
+			_, e = partWriter.Write(data)
+		}
+
+		if e != nil {
+			return body
+		}
+	}
+
+	if !rewritten || writer.Close() != nil {
+		return body
+	}
+
+	ctx.Log("multipart rewriter: request rewritten")
+
+	return out.Bytes()
+}
+
+// Only form fields and textual uploads are rewritten, binary files are
+// passed on untouched
+func isTextPart(part *multipart.Part) bool {
+	if part.Header.Get("content-transfer-encoding") != "" {
+		return false
+	}
+
+	contentType := part.Header.Get("content-type")
+
+	if contentType == "" {
+		return part.FileName() == ""
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	if err != nil {
+		return false
+	}
+
+	return strings.HasPrefix(mediaType, "text/") ||
+		mediaType == "application/json" ||
+		mediaType == "application/x-www-form-urlencoded"
+}
+
+func NewMultipartRewriter(rewriteRoutes []*regexp.Regexp) *MultipartRewriter {
+	return &MultipartRewriter{
+		rewriteRoutes: rewriteRoutes,
+	}
+}
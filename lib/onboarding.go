@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const onboardingPrefix = "/.go-repro/"
+
+// Served even without onboarding if host discovery is enabled
+const discoveredHostsPath = onboardingPrefix + "discovered"
+
+var onboardingTemplate = template.Must(template.New("onboarding").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>go-repro</title>
+</head>
+<body>
+<h1>go-repro</h1>
+{{if .HasCA}}
+<h2>CA certificate</h2>
+<p>
+Install the go-repro development CA as a trusted root on this device in order to
+access TLS enabled mappings without certificate warnings.
+</p>
+<ul>
+<li><a href="{{.Prefix}}ca.crt">ca.crt</a> (DER, Android and iOS)</li>
+<li><a href="{{.Prefix}}ca.pem">ca.pem</a> (PEM)</li>
+</ul>
+<p>
+On iOS, enable full trust for the certificate after installing the profile
+(Settings &rarr; General &rarr; About &rarr; Certificate Trust Settings).
+</p>
+{{end}}
+<h2>Mappings</h2>
+<table>
+<tr><th>local</th><th>remote</th></tr>
+{{range .Mappings}}<tr><td><a href="{{.Local}}/">{{.Local}}</a></td><td>{{.Remote}}</td></tr>
+{{end}}</table>
+{{if .Discovery}}
+<h2>Discovered hosts</h2>
+<p>
+Unmapped hosts referenced by responses (<a href="{{.Prefix}}discovered">JSON</a>).
+</p>
+<table>
+<tr><th>host</th><th>referenced by</th><th>references</th><th>mapped</th></tr>
+{{range .DiscoveredHosts}}<tr><td>{{.Origin}}</td><td>{{.ReferencedBy}}</td><td>{{.References}}</td><td>{{if .Mapped}}yes{{else}}no{{end}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+type onboardingMapping struct {
+	Local  string
+	Remote string
+}
+
+type onboardingPage struct {
+	Prefix          string
+	HasCA           bool
+	Mappings        []onboardingMapping
+	Discovery       bool
+	DiscoveredHosts []DiscoveredHost
+}
+
+// Other paths below the prefix are proxied if onboarding is disabled
+func (p *ProxyServer) servesOnboarding(path string) bool {
+	if p.onboarding {
+		return strings.HasPrefix(path, onboardingPrefix)
+	}
+
+	return path == discoveredHostsPath && p.registry.Discovers()
+}
+
+func (p *ProxyServer) serveOnboarding(outgoing http.ResponseWriter, incoming *http.Request) {
+	path := incoming.URL.Path[len(onboardingPrefix):]
+
+	// Discovery may be enabled without onboarding
+	if path == "discovered" && p.registry.Discovers() {
+		p.serveDiscoveredHosts(outgoing)
+		return
+	}
+
+	if !p.onboarding {
+		http.NotFound(outgoing, incoming)
+		return
+	}
+
+	switch path {
+	case "":
+		p.serveOnboardingPage(outgoing, incoming)
+
+	case "ca.pem":
+		if p.ca != nil {
+			p.serveCACertificate(outgoing, "application/x-pem-file", "ca.pem", p.ca.CertificatePEM())
+		} else {
+			http.NotFound(outgoing, incoming)
+		}
+
+	case "ca.crt":
+		if p.ca != nil {
+			p.serveCACertificate(outgoing, "application/x-x509-ca-cert", "ca.crt", p.ca.CertificateDER())
+		} else {
+			http.NotFound(outgoing, incoming)
+		}
+
+	default:
+		http.NotFound(outgoing, incoming)
+	}
+}
+
+func (p *ProxyServer) serveOnboardingPage(outgoing http.ResponseWriter, incoming *http.Request) {
+	page := onboardingPage{
+		Prefix:          onboardingPrefix,
+		HasCA:           p.ca != nil,
+		Discovery:       p.registry.Discovers(),
+		DiscoveredHosts: p.registry.DiscoveredHosts(),
+	}
+
+	// Use the same host substitution as for rewriting, so the device sees the
+	// URLs that are reachable via the interface it is connected through
+	for _, mapping := range buildHostMappings(p.registry.Mappings(), incoming.Host) {
+		page.Mappings = append(page.Mappings, onboardingMapping{
+			Local:  mapping.local,
+			Remote: mapping.remote,
+		})
+	}
+
+	outgoing.Header().Set("content-type", "text/html; charset=utf-8")
+	outgoing.Header().Set("cache-control", "no-store")
+
+	onboardingTemplate.Execute(outgoing, page)
+}
+
+func (p *ProxyServer) serveDiscoveredHosts(outgoing http.ResponseWriter) {
+	hosts := p.registry.DiscoveredHosts()
+
+	if hosts == nil {
+		hosts = []DiscoveredHost{}
+	}
+
+	outgoing.Header().Set("content-type", "application/json")
+	outgoing.Header().Set("cache-control", "no-store")
+
+	json.NewEncoder(outgoing).Encode(hosts)
+}
+
+func (p *ProxyServer) serveCACertificate(outgoing http.ResponseWriter, contentType, filename string, body []byte) {
+	outgoing.Header().Set("content-type", contentType)
+	outgoing.Header().Set("content-disposition", "attachment; filename=\"go-repro-"+filename+"\"")
+	outgoing.Header().Set("content-length", strconv.Itoa(len(body)))
+
+	outgoing.Write(body)
+}
@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newOnboardingProxy(t *testing.T) *ProxyServer {
+	m1, err := NewMapping("0.0.0.0:8081", "http://foo.bar")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m2, err := NewMapping("https://0.0.0.0:8443", "https://bar.baz")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewProxyServer(m1, []Mapping{m1, m2}, ioutil.Discard, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.SetOnboarding(true)
+
+	return p
+}
+
+func TestOnboardingPage(t *testing.T) {
+	p := newOnboardingProxy(t)
+
+	request := httptest.NewRequest("GET", "http://10.0.2.2:8081/.go-repro/", nil)
+	response := httptest.NewRecorder()
+
+	p.ServeHTTP(response, request)
+
+	body := response.Body.String()
+
+	if !strings.Contains(body, "http://10.0.2.2:8081") || !strings.Contains(body, "https://10.0.2.2:8443") {
+		t.Fatalf("onboarding page should list local URLs for the requested interface, got %s", body)
+	}
+
+	if strings.Contains(body, "ca.crt") {
+		t.Fatal("onboarding page should not offer a certificate without CA")
+	}
+}
+
+func TestOnboardingCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-repro-ca")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	ca, err := LoadOrCreateCertificateAuthority(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newOnboardingProxy(t)
+	p.SetCertificateAuthority(ca)
+
+	request := httptest.NewRequest("GET", "http://10.0.2.2:8081/.go-repro/ca.crt", nil)
+	response := httptest.NewRecorder()
+
+	p.ServeHTTP(response, request)
+
+	if response.Header().Get("content-type") != "application/x-x509-ca-cert" {
+		t.Fatalf("wrong content type %s", response.Header().Get("content-type"))
+	}
+
+	if response.Body.String() != string(ca.CertificateDER()) {
+		t.Fatal("DER certificate does not match CA")
+	}
+
+	request = httptest.NewRequest("GET", "http://10.0.2.2:8081/.go-repro/ca.pem", nil)
+	response = httptest.NewRecorder()
+
+	p.ServeHTTP(response, request)
+
+	if response.Header().Get("content-type") != "application/x-pem-file" ||
+		response.Body.String() != string(ca.CertificatePEM()) {
+
+		t.Fatal("PEM certificate not served correctly")
+	}
+}
@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newPathPrefixContext(t *testing.T) *requestContext {
+	shop, err := NewMapping("10.0.2.2:8081", "http://intranet.dev/shop/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := NewMapping("10.0.2.2:8082", "http://intranet.dev")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := newRequestContext()
+	ctx.incomingRequest = httptest.NewRequest("GET", "/cart", nil)
+	ctx.incomingRequest.Host = "10.0.2.2:8081"
+	ctx.hostMappings = buildHostMappings([]Mapping{shop, root}, ctx.incomingRequest.Host)
+
+	return ctx
+}
+
+func TestPathPrefixMatching(t *testing.T) {
+	ctx := newPathPrefixContext(t)
+	matcher := newRemoteHostMatcher(ctx, true)
+
+	assertHostsReplacedWith(t, matcher, "http://intranet.dev/shop/cart", "http://10.0.2.2:8081/cart")
+	assertHostsReplacedWith(t, matcher, "http://intranet.dev/shop", "http://10.0.2.2:8081")
+	assertHostsReplacedWith(t, matcher, `"http:\/\/intranet.dev\/shop\/cart"`, `"http:\/\/10.0.2.2:8081\/cart"`)
+	assertHostsReplacedWith(t, matcher, "?next=http%3A%2F%2Fintranet.dev%2Fshop%2Fcart", "?next=http%3A%2F%2F10.0.2.2%3A8081%2Fcart")
+	assertHostsReplacedWith(t, matcher, "http://intranet.dev/shopping", "http://10.0.2.2:8082/shopping")
+	assertHostsReplacedWith(t, matcher, "http://intranet.dev/blog", "http://10.0.2.2:8082/blog")
+
+	matcher = newLocalHostMatcher(ctx, true)
+
+	assertHostsReplacedWith(t, matcher, "http://10.0.2.2:8081/cart", "http://intranet.dev/shop/cart")
+	assertHostsReplacedWith(t, matcher, "http%3A%2F%2F10.0.2.2%3A8081%2Fcart", "http%3A%2F%2Fintranet.dev%2Fshop%2Fcart")
+}
+
+func TestPathPrefixRootRelativeUrls(t *testing.T) {
+	ctx := newPathPrefixContext(t)
+
+	for original, expected := range map[string]string{
+		"/shop/cart":                    "/cart",
+		"/shop":                         "/",
+		"/shop?page=2":                  "/?page=2",
+		"/shopping":                     "/shopping",
+		"/blog":                         "/blog",
+		"//intranet.dev/shop/cart":      "http://10.0.2.2:8081/cart",
+		"http://intranet.dev/blog/post": "http://10.0.2.2:8082/blog/post",
+	} {
+		if rewritten, _ := rewriteRemoteUrl(original, ctx); rewritten != expected {
+			t.Fatalf("rewrite of %s failed, got %s, expected %s", original, rewritten, expected)
+		}
+	}
+}
+
+func TestPathPrefixHeaders(t *testing.T) {
+	ctx := newPathPrefixContext(t)
+
+	headers := http.Header{}
+	headers.Set("location", "/shop/login")
+	NewLocationRewriter().RewriteHeaders(headers, ctx)
+
+	if location := headers.Get("location"); location != "/login" {
+		t.Fatalf("unexpected location %s", location)
+	}
+
+	assertSetCookieRewritesTo(t, NewCookieRewriter(false), ctx, "session=1; Path=/shop", "session=1; Path=/")
+	assertSetCookieRewritesTo(t, NewCookieRewriter(false), ctx, "session=1; Path=/shop/cart", "session=1; Path=/cart")
+
+	headers = http.Header{}
+	headers.Set("origin", "http://10.0.2.2:8081")
+	NewCorsRewriter().RewriteIncomingHeaders(headers, ctx)
+
+	if origin := headers.Get("origin"); origin != "http://intranet.dev" {
+		t.Fatalf("unexpected origin %s", origin)
+	}
+
+	headers = http.Header{}
+	headers.Set("access-control-allow-origin", "http://intranet.dev")
+	NewCorsRewriter().RewriteHeaders(headers, ctx)
+
+	if origin := headers.Get("access-control-allow-origin"); origin != "http://10.0.2.2:8081" {
+		t.Fatalf("unexpected access-control-allow-origin %s", origin)
+	}
+}
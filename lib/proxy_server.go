@@ -1,27 +1,69 @@
 package lib
 
 import (
+	"bufio"
 	"bytes"
-	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type redirectCaughtError struct{}
 
+// Tells which mapping failed to serve
+type MappingError struct {
+	Local  string
+	Remote string
+	Err    error
+}
+
+// The lifecycle of a proxy
+const (
+	proxyIdle     = "idle"
+	proxyRunning  = "running"
+	proxyStopping = "stopping"
+	proxyStopped  = "stopped"
+	proxyFailed   = "failed"
+)
+
 type ProxyServer struct {
-	local     string
-	remote    string
-	log       io.Writer
-	rewriters []Rewriter
-	mappings  []Mapping
-	noLogging bool
+	local      string
+	localTLS   bool
+	remote     string
+	log        io.Writer
+	rewriters  []Rewriter
+	registry   *mappingRegistry
+	recorder   *harRecorder
+	noLogging  bool
+	onboarding bool
+	ca         *CertificateAuthority
+
+	rewriteWebsockets bool
+	tlsConfig         *tls.Config
+	requestHeaders    http.Header
+
+	// Set if the mapping is served as a virtual host
+	virtualHostName string
+	virtualHostPath string
+
+	state      string
+	stateMutex sync.Mutex
+
+	// Replaced on config reloads, requests in flight finish with the old one
+	reloaded atomic.Value
+
+	// Shared with the replacements
+	websockets *websocketConns
 
 	server http.Server
 	client http.Client
@@ -31,17 +73,30 @@ type requestContext struct {
 	incomingRequest       *http.Request
 	upstreamResponse      *http.Response
 	hostMappings          []HostMapping
+	registry              *mappingRegistry
 	outgoingHeaders       http.Header
 	logs                  []string
 	contentLength         int
 	suppressContentLength bool
 	requestUrl            string
+	streaming             bool
+	sentLogs              int
+	exchange              *harExchange
+	mutex                 sync.Mutex
 }
 
 func (c redirectCaughtError) Error() string {
 	return "redirect caught"
 }
 
+func (e *MappingError) Error() string {
+	return fmt.Sprintf("%s=%s: %v", e.Local, e.Remote, e.Err)
+}
+
+func (e *MappingError) Unwrap() error {
+	return e.Err
+}
+
 func (r *requestContext) IncomingRequest() *http.Request {
 	return r.incomingRequest
 }
@@ -51,16 +106,72 @@ func (r *requestContext) UpstreamResponse() *http.Response {
 }
 
 func (r *requestContext) HostMappings() []HostMapping {
+	// Wildcard mappings may be added while streaming
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
 	return r.hostMappings
 }
 
+func (r *requestContext) wildcardOrigins() (origins []urlOrigin) {
+	if r.registry == nil {
+		return
+	}
+
+	for _, w := range r.registry.Wildcards() {
+		origins = append(origins, w.origin())
+	}
+
+	return
+}
+
+func (r *requestContext) discoversHosts() bool {
+	return r.registry != nil && r.registry.Discovers()
+}
+
+func (r *requestContext) resolveRemote(remote string) (local string, ok bool) {
+	if r.registry == nil {
+		return
+	}
+
+	m, ok := r.registry.resolve(remote, r.RequestUrl())
+
+	if !ok {
+		return
+	}
+
+	hostMappings := buildHostMappings(r.registry.Mappings(), r.incomingRequest.Host)
+
+	r.mutex.Lock()
+	r.hostMappings = hostMappings
+	r.mutex.Unlock()
+
+	for _, h := range hostMappings {
+		if h.remote == m.remote {
+			r.Log(fmt.Sprintf("mapped %s to %s", h.remote, h.local))
+			return h.local, true
+		}
+	}
+
+	return "", false
+}
+
 func (r *requestContext) Log(message string) {
+	// Streaming rewriters may log from their own goroutine
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
 	r.logs = append(r.logs, message)
 }
 
 func (r *requestContext) RequestUrl() string {
 	if r.requestUrl == "" {
-		r.requestUrl = "http://" + r.incomingRequest.Host + r.incomingRequest.RequestURI
+		scheme := "http://"
+		if r.incomingRequest.TLS != nil {
+			scheme = "https://"
+		}
+
+		r.requestUrl = scheme + r.incomingRequest.Host + r.incomingRequest.RequestURI
 	}
 
 	return r.requestUrl
@@ -76,13 +187,36 @@ func newRequestContext() *requestContext {
 func (p *ProxyServer) ServeHTTP(outgoing http.ResponseWriter, incoming *http.Request) {
 	var err error
 
+	if current := p.current(); current != p {
+		current.ServeHTTP(outgoing, incoming)
+		return
+	}
+
+	if p.servesOnboarding(incoming.URL.Path) {
+		p.serveOnboarding(outgoing, incoming)
+		return
+	}
+
 	ctx := newRequestContext()
-	ctx.hostMappings = buildHostMappings(p.mappings, incoming.Host)
+	ctx.hostMappings = buildHostMappings(p.registry.Mappings(), incoming.Host)
+	ctx.registry = p.registry
 	ctx.incomingRequest = incoming
 
+	// Websocket traffic is not recorded, not even the handshake
+	if isWebsocketUpgrade(incoming) {
+		p.serveWebsocket(outgoing, ctx)
+		return
+	}
+
+	if p.recorder != nil {
+		ctx.exchange = newHarExchange(incoming)
+		defer p.recorder.record(ctx)
+	}
+
 	upstreamRequest, err := p.buildUpstreamRequest(ctx)
 
 	if err == nil {
+		ctx.exchange.waiting(upstreamRequest)
 		ctx.upstreamResponse, err = p.client.Do(upstreamRequest)
 
 		if isRedirectError(err) {
@@ -90,6 +224,8 @@ func (p *ProxyServer) ServeHTTP(outgoing http.ResponseWriter, incoming *http.Req
 		}
 	}
 
+	ctx.exchange.received(err)
+
 	if err != nil {
 		fmt.Fprintf(p.log, "error during proxy request: %v\n", err)
 		http.Error(outgoing, err.Error(), http.StatusBadGateway)
@@ -110,9 +246,25 @@ func isRedirectError(err error) (q bool) {
 }
 
 func (p *ProxyServer) buildUpstreamRequest(ctx *requestContext) (outgoing *http.Request, err error) {
+	requestUri := ctx.incomingRequest.RequestURI
+
+	if p.virtualHostPath != "" && hasUrlPrefix(requestUri, p.virtualHostPath) {
+		requestUri = requestUri[len(p.virtualHostPath):]
+
+		if !strings.HasPrefix(requestUri, "/") {
+			requestUri = "/" + requestUri
+		}
+	}
+
+	for _, rewriter := range p.rewriters {
+		if rewriter, ok := rewriter.(IncomingUrlRewriter); ok {
+			requestUri = rewriter.RewriteIncomingUrl(requestUri, ctx)
+		}
+	}
+
 	outgoing, err = http.NewRequest(
 		ctx.incomingRequest.Method,
-		p.remote+ctx.incomingRequest.RequestURI,
+		httpUrl(p.remote)+requestUri,
 		ctx.incomingRequest.Body)
 
 	if err != nil {
@@ -131,8 +283,59 @@ func (p *ProxyServer) buildUpstreamRequest(ctx *requestContext) (outgoing *http.
 		}
 	}
 
+	for key, values := range p.requestHeaders {
+		outgoing.Header[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+	}
+
+	outgoing.ContentLength = ctx.incomingRequest.ContentLength
+
+	if err = p.rewriteIncomingBody(outgoing, ctx); err != nil {
+		return
+	}
+
 	// We also try to compress upstream communication
-	outgoing.Header.Set("accept-encoding", "gzip")
+	outgoing.Header.Set("accept-encoding", upstreamAcceptEncoding)
+
+	return
+}
+
+func (p *ProxyServer) rewriteIncomingBody(outgoing *http.Request, ctx *requestContext) (err error) {
+	if outgoing.Body == nil || outgoing.Body == http.NoBody {
+		return
+	}
+
+	// We do not decompress request bodies
+	if outgoing.Header.Get("content-encoding") != "" {
+		return
+	}
+
+	bodyRewriters := make([]IncomingBodyRewriter, 0, 2)
+
+	for _, rewriter := range p.rewriters {
+		if rewriter, ok := rewriter.(IncomingBodyRewriter); ok && rewriter.MatchesIncoming(ctx) {
+			bodyRewriters = append(bodyRewriters, rewriter)
+		}
+	}
+
+	if len(bodyRewriters) == 0 {
+		return
+	}
+
+	bodyData, err := ioutil.ReadAll(outgoing.Body)
+	outgoing.Body.Close()
+
+	if err != nil {
+		return
+	}
+
+	for _, rewriter := range bodyRewriters {
+		bodyData = rewriter.RewriteIncomingBody(bodyData, ctx)
+	}
+
+	outgoing.Body = ioutil.NopCloser(bytes.NewReader(bodyData))
+	outgoing.ContentLength = int64(len(bodyData))
+	outgoing.Header.Set("content-length", strconv.Itoa(len(bodyData)))
+	outgoing.Header.Del("transfer-encoding")
 
 	return
 }
@@ -147,6 +350,13 @@ func (p *ProxyServer) sendResponse(outgoing http.ResponseWriter, ctx *requestCon
 	bodyRewriters := p.rewriteOutgoingHeaders(ctx)
 	rewriteBody := len(bodyRewriters) > 0
 
+	if encoding := normalizeEncoding(ctx.upstreamResponse.Header.Get("content-encoding")); rewriteBody &&
+		encoding != "" && encoding != "identity" && !isSupportedEncoding(encoding) {
+
+		ctx.Log(fmt.Sprintf("not rewriting body with unsupported content encoding %s", encoding))
+		rewriteBody = false
+	}
+
 	bodyReader, bodyWriter, err :=
 		p.handleCompression(ctx.upstreamResponse.Body, outgoing, rewriteBody, ctx)
 	if err != nil {
@@ -154,27 +364,96 @@ func (p *ProxyServer) sendResponse(outgoing http.ResponseWriter, ctx *requestCon
 		return
 	}
 
+	// Bodies passed on as they are may still be compressed
+	var capturedEncoding string
+	if bodyReader == io.Reader(ctx.upstreamResponse.Body) {
+		capturedEncoding = ctx.upstreamResponse.Header.Get("content-encoding")
+	} else if decoder, ok := bodyReader.(io.Closer); ok {
+		defer decoder.Close()
+	}
+
+	bodyReader = ctx.exchange.captureUpstreamBody(bodyReader, capturedEncoding)
+
 	if rewriteBody {
-		bodyReader = p.rewriteBody(bodyReader, bodyRewriters, ctx)
+		if streamingRewriters := asStreamingRewriters(bodyRewriters); streamingRewriters != nil {
+			bodyReader = p.rewriteBodyStream(bodyReader, streamingRewriters, ctx)
+		} else {
+			bodyReader = p.rewriteBody(bodyReader, bodyRewriters, ctx)
+		}
 	}
 
+	bodyReader = ctx.exchange.captureResponseBody(bodyReader, capturedEncoding)
+
 	p.setupContentLength(ctx)
 
 	// Add the log
 	if !p.noLogging {
 		p.addLog(ctx)
+
+		// Undeclared trailers are dropped if the response fits into a single write
+		if ctx.streaming {
+			ctx.outgoingHeaders.Set("trailer", "x-go-repro-log")
+		}
 	}
 
 	// Send headers
 	outgoing.WriteHeader(ctx.upstreamResponse.StatusCode)
 
 	// Send body
-	io.Copy(bodyWriter, bodyReader)
+	if isLongLivedResponse(ctx) {
+		p.copyBodyFlushing(outgoing, bodyWriter, bodyReader)
+	} else {
+		io.Copy(bodyWriter, bodyReader)
+	}
 
 	// Close writer if applicable (looking at you, gzip)
 	if bodyWriter, ok := bodyWriter.(io.Closer); ok {
 		bodyWriter.Close()
 	}
+
+	// Terminate streaming rewriters in case the copy was aborted
+	if bodyReader, ok := bodyReader.(io.Closer); ok {
+		bodyReader.Close()
+	}
+
+	// Logs of streaming rewriters are only complete now, so we send them as trailers
+	if ctx.streaming && !p.noLogging {
+		p.addTrailerLog(outgoing, ctx)
+	}
+}
+
+// Event streams and other responses of unknown length may stay open for a long
+// time and need to reach the client as soon as the upstream sends them
+func isLongLivedResponse(ctx *requestContext) bool {
+	return responseMediaType(ctx) == "text/event-stream" || ctx.upstreamResponse.ContentLength < 0
+}
+
+func (p *ProxyServer) copyBodyFlushing(outgoing http.ResponseWriter, writer io.Writer, reader io.Reader) {
+	buffer := make([]byte, streamChunkSize)
+	flusher, _ := outgoing.(http.Flusher)
+
+	for {
+		n, err := reader.Read(buffer)
+
+		if n > 0 {
+			if _, e := writer.Write(buffer[:n]); e != nil {
+				return
+			}
+
+			// Compressing writers need to be flushed first
+			if writer, ok := writer.(interface{ Flush() error }); ok {
+				writer.Flush()
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
 }
 
 func (p *ProxyServer) setupOutgoingHeaders(outgoing http.ResponseWriter, ctx *requestContext) (outgoingHeaders http.Header) {
@@ -197,11 +476,9 @@ func (p *ProxyServer) setupOutgoingHeaders(outgoing http.ResponseWriter, ctx *re
 	outgoingHeaders.Del("transfer-encoding")
 
 	// We need to remove any domain information set on the cookies
-	outgoingHeaders.Del("set-cookie")
-	for _, cookie := range ctx.upstreamResponse.Cookies() {
-		cookie.Domain = ""
-
-		http.SetCookie(outgoing, cookie)
+	cookies := outgoingHeaders["Set-Cookie"]
+	for i, cookie := range cookies {
+		cookies[i] = stripCookieDomain(cookie)
 	}
 
 	return
@@ -232,40 +509,53 @@ func (p *ProxyServer) handleCompression(readerIn io.Reader, writerIn io.Writer,
 	readerOut = readerIn
 	writerOut = writerIn
 
-	// We are ignoring any q-value here, so this is wrong for the case q=0
-	clientAcceptsGzip := strings.Contains(ctx.incomingRequest.Header.Get("accept-encoding"), "gzip")
+	upstreamEncoding := normalizeEncoding(ctx.upstreamResponse.Header.Get("content-encoding"))
+	accepted := parseAcceptEncoding(ctx.incomingRequest.Header.Get("accept-encoding"))
 
-	if ctx.upstreamResponse.Header.Get("content-encoding") == "gzip" &&
-		(rewriteResponse || !clientAcceptsGzip) {
+	if upstreamEncoding == "" || upstreamEncoding == "identity" || !hasBody(ctx) {
+		return
+	}
 
-		var e error
-		readerOut, e = gzip.NewReader(readerIn)
-		if e != nil {
-			// Work around the closed-body-on-redirect bug in the runtime
-			// https://github.com/golang/go/issues/10069
-			readerOut = readerIn
-			return
-		}
+	if !rewriteResponse && (accepted.accepts(upstreamEncoding) || !isSupportedEncoding(upstreamEncoding)) {
+		return
+	}
 
-		if clientAcceptsGzip {
-			writerOut = gzip.NewWriter(writerIn)
-			ctx.suppressContentLength = true
-			ctx.outgoingHeaders.Set("content-encoding", "gzip")
-		} else {
-			ctx.outgoingHeaders.Del("content-encoding")
-		}
+	var e error
+	readerOut, e = newDecodingReader(upstreamEncoding, readerIn)
+	if e != nil {
+		// See rewriteBody
+		readerOut = readerIn
+		return
+	}
+
+	// The upstream content length refers to the encoded body
+	ctx.contentLength = -1
+
+	if encoding := accepted.negotiate(upstreamEncoding); encoding != "" {
+		writerOut, err = newEncodingWriter(encoding, writerIn)
+		ctx.suppressContentLength = true
+		ctx.outgoingHeaders.Set("content-encoding", encoding)
+	} else {
+		ctx.outgoingHeaders.Del("content-encoding")
 	}
 
 	return
 }
 
+func hasBody(ctx *requestContext) bool {
+	switch ctx.upstreamResponse.StatusCode {
+	case http.StatusNoContent, http.StatusNotModified:
+		return false
+	}
+
+	return ctx.incomingRequest.Method != "HEAD"
+}
+
 func (p *ProxyServer) rewriteBody(reader io.Reader, bodyRewriters []BodyRewriter, ctx *requestContext) io.Reader {
 	bodyData, err := ioutil.ReadAll(reader)
 
 	if err == nil {
-		for _, rewriter := range bodyRewriters {
-			bodyData = rewriter.RewriteResponse(bodyData, ctx)
-		}
+		bodyData = p.rewriteBodyData(bodyData, bodyRewriters, ctx)
 	} else {
 		// Work around the closed-body-on-redirect bug in the runtime
 		// https://github.com/golang/go/issues/10069
@@ -277,10 +567,134 @@ func (p *ProxyServer) rewriteBody(reader io.Reader, bodyRewriters []BodyRewriter
 	return bytes.NewBuffer(bodyData)
 }
 
+func asStreamingRewriters(bodyRewriters []BodyRewriter) (streamingRewriters []StreamingBodyRewriter) {
+	for _, rewriter := range bodyRewriters {
+		streamingRewriter, ok := rewriter.(StreamingBodyRewriter)
+
+		// The body is buffered if any rewriter requires it
+		if !ok {
+			return nil
+		}
+
+		streamingRewriters = append(streamingRewriters, streamingRewriter)
+	}
+
+	return
+}
+
+func (p *ProxyServer) rewriteBodyStream(reader io.Reader, streamingRewriters []StreamingBodyRewriter, ctx *requestContext) io.Reader {
+	var charset *bodyCharset
+
+	buffered := bufio.NewReaderSize(reader, charsetPrescanLength)
+
+	contentType := ctx.upstreamResponse.Header.Get("content-type")
+	mediaType := responseMediaType(ctx)
+
+	// Only HTML and CSS declare their charset in the document, other bodies are
+	// not held back beyond a byte order mark. Errors resurface during the read.
+	switch {
+	case hasCharsetParameter(contentType):
+		charset = detectBodyCharset(nil, contentType)
+
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml" || mediaType == "text/css":
+		prefix, _ := buffered.Peek(charsetPrescanLength)
+		charset = detectBodyCharset(prefix, contentType)
+
+	case mediaType != "text/event-stream":
+		prefix, _ := buffered.Peek(len(boms[0].bom))
+		charset = detectBodyCharset(prefix, contentType)
+	}
+
+	reader = buffered
+	if charset != nil {
+		buffered.Discard(len(charset.bom))
+		reader = charset.decodeReader(buffered)
+	}
+
+	body := &streamingBody{}
+
+	for _, rewriter := range streamingRewriters {
+		reader = rewriter.RewriteResponseStream(reader, ctx)
+
+		if closer, ok := reader.(io.Closer); ok {
+			body.closers = append(body.closers, closer)
+		}
+	}
+
+	if charset != nil {
+		reader = charset.encodeReader(reader)
+	}
+
+	body.Reader = reader
+
+	// The length of the rewritten body is unknown, so it is sent chunked
+	ctx.streaming = true
+	ctx.contentLength = -1
+
+	return body
+}
+
+func (p *ProxyServer) rewriteBodyData(bodyData []byte, bodyRewriters []BodyRewriter, ctx *requestContext) []byte {
+	// Rewriters operate on UTF-8, so other charsets are transcoded back and forth
+	charset := detectBodyCharset(bodyData, ctx.upstreamResponse.Header.Get("content-type"))
+	text := bodyData
+
+	if charset != nil {
+		decoded, err := charset.decode(bodyData)
+
+		if err != nil {
+			fmt.Fprintf(p.log, "unable to decode %s response body: %v\n", charset.name, err)
+			charset = nil
+		} else {
+			text = decoded
+		}
+	}
+
+	decoded := text
+
+	for _, rewriter := range bodyRewriters {
+		text = rewriter.RewriteResponse(text, ctx)
+	}
+
+	if charset == nil {
+		return text
+	}
+
+	if bytes.Equal(text, decoded) {
+		return bodyData
+	}
+
+	encoded, err := charset.encode(text)
+
+	if err != nil {
+		fmt.Fprintf(p.log, "unable to encode %s response body: %v\n", charset.name, err)
+		return bodyData
+	}
+
+	return encoded
+}
+
 func (p *ProxyServer) addLog(ctx *requestContext) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
 	for _, entry := range ctx.logs {
 		ctx.outgoingHeaders.Add("x-go-repro-log", entry)
 	}
+
+	ctx.sentLogs = len(ctx.logs)
+}
+
+func (p *ProxyServer) addTrailerLog(outgoing http.ResponseWriter, ctx *requestContext) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	// The header values have been sent already
+	outgoing.Header().Del("x-go-repro-log")
+
+	for _, entry := range ctx.logs[ctx.sentLogs:] {
+		outgoing.Header().Add("x-go-repro-log", entry)
+	}
 }
 
 func (p *ProxyServer) setupContentLength(ctx *requestContext) {
@@ -290,17 +704,136 @@ func (p *ProxyServer) setupContentLength(ctx *requestContext) {
 }
 
 func (p *ProxyServer) Start() <-chan error {
+	return p.run(func() error {
+		if p.localTLS {
+			return p.server.ListenAndServeTLS("", "")
+		}
+
+		return p.server.ListenAndServe()
+	})
+}
+
+// Serves on a listener that has already been opened, e.g. for ports that are
+// allocated at runtime
+func (p *ProxyServer) serve(listener net.Listener) <-chan error {
+	return p.run(func() error {
+		if p.localTLS {
+			return p.server.ServeTLS(listener, "", "")
+		}
+
+		return p.server.Serve(listener)
+	})
+}
+
+func (p *ProxyServer) run(serve func() error) <-chan error {
 	c := make(chan error, 1)
 
+	scheme := "http://"
+	if p.localTLS {
+		scheme = "https://"
+	}
+
+	p.setState(proxyRunning)
+
 	go func() {
-		c <- p.server.ListenAndServe()
+		err := serve()
+
+		// After a shutdown, the state is maintained by Shutdown
+		if err != http.ErrServerClosed {
+			p.setState(proxyFailed)
+			err = &MappingError{scheme + p.local, p.remote, err}
+		}
+
+		c <- err
 	}()
 
-	fmt.Fprintf(p.log, "proxying requests for %s to %s\n", p.local, p.remote)
+	fmt.Fprintf(p.log, "proxying requests for %s%s to %s\n", scheme, p.local, p.remote)
 
 	return c
 }
 
+// Serves until the context is done, then waits up to the drain timeout for
+// active requests to complete
+func (p *ProxyServer) Run(ctx context.Context, drainTimeout time.Duration) (err error) {
+	select {
+	case err = <-p.Start():
+		if err == http.ErrServerClosed {
+			err = nil
+		}
+
+		return
+
+	case <-ctx.Done():
+	}
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	return p.Shutdown(drainCtx)
+}
+
+// Stops accepting connections and waits for active requests to complete.
+// Connections that are still active when the context is done are closed,
+// websocket connections are closed right away.
+func (p *ProxyServer) Shutdown(ctx context.Context) (err error) {
+	// Failed servers are not listening anyway
+	if p.State() == proxyFailed {
+		return
+	}
+
+	p.setState(proxyStopping)
+	p.websockets.closeAll()
+
+	if err = p.server.Shutdown(ctx); err != nil {
+		p.server.Close()
+	}
+
+	p.closeIdleConnections()
+	p.setState(proxyStopped)
+
+	return
+}
+
+// Releases the upstream connections of the proxy and its replacements
+func (p *ProxyServer) closeIdleConnections() {
+	p.client.CloseIdleConnections()
+
+	if current := p.current(); current != p {
+		current.client.CloseIdleConnections()
+	}
+}
+
+// The proxy that handles requests with the settings of the last config reload
+func (p *ProxyServer) current() *ProxyServer {
+	if reloaded, ok := p.reloaded.Load().(*ProxyServer); ok {
+		return reloaded
+	}
+
+	return p
+}
+
+func (p *ProxyServer) reload(replacement *ProxyServer) {
+	replacement.websockets = p.websockets
+
+	previous := p.current()
+	p.reloaded.Store(replacement)
+	previous.client.CloseIdleConnections()
+}
+
+func (p *ProxyServer) State() string {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	return p.state
+}
+
+func (p *ProxyServer) setState(state string) {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+
+	p.state = state
+}
+
 func (p *ProxyServer) AddRewriter(r Rewriter) {
 	p.rewriters = append(p.rewriters, r)
 }
@@ -309,13 +842,49 @@ func (p *ProxyServer) SetNoLogging(flag bool) {
 	p.noLogging = flag
 }
 
+func (p *ProxyServer) SetOnboarding(flag bool) {
+	p.onboarding = flag
+}
+
+func (p *ProxyServer) SetRewriteWebsockets(flag bool) {
+	p.rewriteWebsockets = flag
+}
+
+func (p *ProxyServer) SetTimeout(timeout time.Duration) {
+	p.client.Transport.(*http.Transport).ResponseHeaderTimeout = timeout
+}
+
+func (p *ProxyServer) SetRequestHeaders(headers http.Header) {
+	p.requestHeaders = headers
+}
+
+func (p *ProxyServer) SetCertificateAuthority(ca *CertificateAuthority) {
+	p.ca = ca
+
+	if p.localTLS {
+		p.server.TLSConfig = &tls.Config{
+			GetCertificate: ca.GetCertificate,
+		}
+	}
+}
+
 func NewProxyServer(m Mapping, mappings []Mapping, log io.Writer, sslAllowInsecure bool) (p *ProxyServer, err error) {
 	p = &ProxyServer{
 		local:     m.local,
+		localTLS:  m.localTLS,
 		remote:    m.remote,
 		log:       log,
 		rewriters: make([]Rewriter, 0),
-		mappings:  mappings,
+		registry:  newMappingRegistry(mappings),
+		state:     proxyIdle,
+
+		websockets: newWebsocketConns(),
+
+		virtualHostPath: m.virtualHostPath(),
+	}
+
+	if m.virtualHost != "" {
+		p.virtualHostName = m.remoteHostname()
 	}
 
 	p.server = http.Server{
@@ -323,9 +892,8 @@ func NewProxyServer(m Mapping, mappings []Mapping, log io.Writer, sslAllowInsecu
 		Handler: p,
 	}
 
-	var tlsConfig *tls.Config
 	if sslAllowInsecure {
-		tlsConfig = &tls.Config{
+		p.tlsConfig = &tls.Config{
 			InsecureSkipVerify: true,
 		}
 	}
@@ -337,7 +905,7 @@ func NewProxyServer(m Mapping, mappings []Mapping, log io.Writer, sslAllowInsecu
 		Transport: &http.Transport{
 			// We rather handle compression ourselves
 			DisableCompression: true,
-			TLSClientConfig:    tlsConfig,
+			TLSClientConfig:    p.tlsConfig,
 		},
 	}
 
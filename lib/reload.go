@@ -0,0 +1,301 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Settings that are only applied on startup
+func (c *Config) restartRequired(other Config) string {
+	switch {
+	case c.caDir != other.caDir:
+		return "ca-dir"
+
+	case c.virtualHosting != other.virtualHosting:
+		return "virtual-hosts"
+
+	case c.adminAddress != other.adminAddress:
+		return "admin"
+
+	case c.discovery != other.discovery:
+		return "discovery"
+
+	case c.recordingDir != other.recordingDir || c.recordingMaxSize != other.recordingMaxSize:
+		return "recording"
+	}
+
+	return ""
+}
+
+// Mappings are the same if they only differ by their options
+func (m *Mapping) key() string {
+	return fmt.Sprintf("%t %s %s %s", m.localTLS, m.local, strings.ToLower(m.remote), m.virtualHost)
+}
+
+// Applies a changed config, restarting only added or removed mappings
+func (r *Repro) Reload(cfg Config) (err error) {
+	if setting := r.cfg.restartRequired(cfg); setting != "" {
+		err = errors.New(fmt.Sprintf("changing %s requires a restart", setting))
+		return
+	}
+
+	if cfg.usesLocalTLS() && r.ca == nil {
+		err = errors.New("adding the first https mapping requires a restart")
+		return
+	}
+
+	cfg.log = r.log
+
+	mappings, err := virtualHostMappings(cfg.mappings, cfg.virtualHosting)
+
+	if err != nil {
+		return
+	}
+
+	previous, _ := virtualHostMappings(r.cfg.mappings, r.cfg.virtualHosting)
+
+	before := make(map[string]bool)
+	for _, m := range previous {
+		before[m.key()] = true
+	}
+
+	after := make(map[string]bool)
+	for _, m := range mappings {
+		after[m.key()] = true
+	}
+
+	var removed []Mapping
+	freed := make(map[string]bool)
+
+	// Mappings removed via the admin API are gone already
+	for _, m := range previous {
+		if !after[m.key()] && r.findProxy(m) != nil {
+			removed = append(removed, m)
+			freed[m.local] = true
+		}
+	}
+
+	var added []Mapping
+	replacements := make(map[*ProxyServer]*ProxyServer)
+
+	for _, m := range mappings {
+		proxy := r.findProxy(m)
+
+		if !before[m.key()] || proxy == nil {
+			added = append(added, m)
+			continue
+		}
+
+		replacements[proxy], err = r.newProxyServer(cfg, m)
+
+		if err != nil {
+			return
+		}
+	}
+
+	// Runtime mappings use the global options
+	for _, m := range r.registry.Mappings() {
+		if before[m.key()] || after[m.key()] {
+			continue
+		}
+
+		if proxy := r.findProxy(m); proxy != nil {
+			if replacements[proxy], err = r.newProxyServer(cfg, m); err != nil {
+				return
+			}
+		}
+	}
+
+	if err = r.checkLocals(added, freed); err != nil {
+		return
+	}
+
+	listeners, err := r.listen(added, freed)
+
+	if err != nil {
+		return
+	}
+
+	r.registry.mutex.Lock()
+	r.cfg = cfg
+	r.registry.wildcards = cfg.wildcardMappings
+	r.registry.mutex.Unlock()
+
+	if r.registry.discovery != nil {
+		r.registry.discovery.configure(cfg.discoveryAllowlist, cfg.discoveryPorts)
+	}
+
+	for proxy, replacement := range replacements {
+		proxy.reload(replacement)
+	}
+
+	var failures []string
+
+	for _, m := range removed {
+		if e := r.RemoveMapping(m.local, m.remote); e != nil {
+			failures = append(failures, e.Error())
+		}
+	}
+
+	for _, m := range added {
+		listener := listeners[m.local]
+		delete(listeners, m.local)
+
+		if e := r.startConfiguredMapping(m, listener); e != nil {
+			failures = append(failures, e.Error())
+		}
+	}
+
+	fmt.Fprintf(r.log, "reloaded config: %d mappings added, %d removed, %d updated\n", len(added), len(removed), len(replacements))
+
+	if len(failures) > 0 {
+		err = errors.New(strings.Join(failures, "; "))
+	}
+
+	return
+}
+
+// Opens the new listeners up front, freed addresses only after removal
+func (r *Repro) listen(added []Mapping, freed map[string]bool) (listeners map[string]net.Listener, err error) {
+	listeners = make(map[string]net.Listener)
+
+	for _, m := range added {
+		if freed[m.local] || listeners[m.local] != nil || (m.virtualHost != "" && r.hasVirtualHost(m.local)) {
+			continue
+		}
+
+		listener, e := net.Listen("tcp", m.local)
+
+		if e != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+
+			return nil, e
+		}
+
+		listeners[m.local] = listener
+	}
+
+	return
+}
+
+func (r *Repro) findProxy(m Mapping) *ProxyServer {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, p := range r.proxies {
+		if p.local == m.local && strings.EqualFold(p.remote, m.remote) {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// Added mappings may only share local addresses with virtual hosts
+func (r *Repro) checkLocals(added []Mapping, freed map[string]bool) (err error) {
+	r.registry.mutex.RLock()
+	defer r.registry.mutex.RUnlock()
+
+	for _, m := range added {
+		if freed[m.local] || !r.registry.usesLocal(m.local) {
+			continue
+		}
+
+		if m.virtualHost != "" && r.hasVirtualHost(m.local) {
+			continue
+		}
+
+		err = errors.New(fmt.Sprintf("%s: local address is already in use", m.local))
+		return
+	}
+
+	return
+}
+
+func (r *Repro) hasVirtualHost(local string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, v := range r.virtualHosts {
+		if v.local == local {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Starts a mapping from a reloaded config, opening the listener if nil
+func (r *Repro) startConfiguredMapping(m Mapping, listener net.Listener) (err error) {
+	r.registry.mutex.Lock()
+	defer r.registry.mutex.Unlock()
+
+	if m.virtualHost == "" {
+		if listener == nil {
+			if listener, err = net.Listen("tcp", m.local); err != nil {
+				return
+			}
+		}
+
+		if _, err = r.startMapping(m, listener); err == nil {
+			r.registry.add(m)
+		}
+
+		return
+	}
+
+	p, err := r.newProxyServer(r.cfg, m)
+
+	if err != nil {
+		if listener != nil {
+			listener.Close()
+		}
+
+		return
+	}
+
+	r.mutex.Lock()
+
+	if r.stopping {
+		r.mutex.Unlock()
+
+		if listener != nil {
+			listener.Close()
+		}
+
+		return errShuttingDown
+	}
+
+	v, created := r.virtualHost(m)
+	r.mutex.Unlock()
+
+	if created {
+		if listener == nil {
+			if listener, err = net.Listen("tcp", m.local); err != nil {
+				r.removeVirtualHost(v)
+				return
+			}
+		}
+
+		v.AddProxy(p)
+		r.forward(v.serve(listener))
+	} else {
+		if listener != nil {
+			listener.Close()
+		}
+
+		v.startProxy(p)
+	}
+
+	r.mutex.Lock()
+	r.proxies = append(r.proxies, p)
+	r.mutex.Unlock()
+
+	r.registry.add(m)
+
+	return
+}
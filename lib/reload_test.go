@@ -0,0 +1,198 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html")
+		fmt.Fprint(w, `<a href="http://removed.test/"></a><a href="http://added.test/"></a>`)
+	}))
+	defer upstream.Close()
+
+	proxy := httptest.NewUnstartedServer(nil)
+	removed := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	added := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+
+	cfg := NewConfig()
+	cfg.SetLog(ioutil.Discard)
+	cfg.AddRewriteRoute("^/rewritten")
+	cfg.AddMapping(proxy.Listener.Addr().String(), upstream.URL)
+	cfg.AddMapping(removed, "http://removed.test")
+
+	r, err := NewRepro(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.Config.Handler = r.proxies[0]
+	proxy.Start()
+	defer proxy.Close()
+
+	if body := get(t, proxy.URL+"/"); body != `<a href="http://removed.test/"></a><a href="http://added.test/"></a>` {
+		t.Fatalf("response should not be rewritten, got %s", body)
+	}
+
+	reloaded := NewConfig()
+	reloaded.AddRewriteRoute(".")
+	reloaded.AddMapping(proxy.Listener.Addr().String(), upstream.URL)
+	reloaded.AddMapping(added, "http://added.test")
+
+	if err = r.Reload(reloaded); err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.RemoveMapping(added, "")
+
+	expected := fmt.Sprintf(`<a href="http://removed.test/"></a><a href="http://%s/"></a>`, added)
+
+	if body := get(t, proxy.URL+"/"); body != expected {
+		t.Fatalf("unexpected body %s, expected %s", body, expected)
+	}
+
+	states := r.MappingStates()
+
+	if len(states) != 2 || states[0].Remote != upstream.URL || states[1].Local != added || states[1].State != proxyRunning {
+		t.Fatalf("unexpected mappings %v", states)
+	}
+
+	invalid := reloaded
+	invalid.SetVirtualHosting(VirtualHostByPath)
+	invalid.AddMapping(removed, "http://removed.test")
+
+	if err = r.Reload(invalid); err == nil {
+		t.Fatal("changing the virtual hosting should be an error")
+	}
+
+	if len(r.registry.Mappings()) != 2 {
+		t.Fatal("invalid config should not be applied")
+	}
+}
+
+func get(t *testing.T, url string) string {
+	response, err := http.Get(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(body)
+}
+
+func TestReloadWithBusyListener(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer busy.Close()
+
+	kept := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	removed := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+
+	cfg := NewConfig()
+	cfg.SetLog(ioutil.Discard)
+	cfg.AddMapping(kept, "http://kept.test")
+	cfg.AddMapping(removed, "http://removed.test")
+
+	r, err := NewRepro(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+
+	go func() {
+		stopped <- r.Run(ctx, time.Second)
+	}()
+
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	waitForListener(t, removed, true)
+
+	free := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+
+	reloaded := NewConfig()
+	reloaded.AddRewriteRoute(".")
+	reloaded.AddMapping(kept, "http://kept.test")
+	reloaded.AddMapping(free, "http://free.test")
+	reloaded.AddMapping(busy.Addr().String(), "http://busy.test")
+
+	if err = r.Reload(reloaded); err == nil {
+		t.Fatal("busy listener should be an error")
+	}
+
+	if len(r.cfg.rewriteRoutes) != 0 || len(r.registry.Mappings()) != 2 || r.proxies[0].current() != r.proxies[0] {
+		t.Fatal("old config should stay active")
+	}
+
+	// The listeners opened meanwhile are closed again
+	waitForListener(t, free, false)
+	waitForListener(t, removed, true)
+}
+
+func TestReloadRuntimeMappings(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html")
+		fmt.Fprint(w, `<a href="http://kept.test/"></a>`)
+	}))
+	defer upstream.Close()
+
+	kept := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	runtime := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+
+	cfg := NewConfig()
+	cfg.SetLog(ioutil.Discard)
+	cfg.AddMapping(kept, "http://kept.test")
+
+	r, err := NewRepro(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = r.AddMapping(runtime, upstream.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.RemoveMapping(runtime, "")
+
+	if body := get(t, "http://"+runtime+"/"); body != `<a href="http://kept.test/"></a>` {
+		t.Fatalf("response should not be rewritten, got %s", body)
+	}
+
+	reloaded := NewConfig()
+	reloaded.AddRewriteRoute(".")
+	reloaded.AddMapping(kept, "http://kept.test")
+
+	if err = r.Reload(reloaded); err != nil {
+		t.Fatal(err)
+	}
+
+	if body := get(t, "http://"+runtime+"/"); body != fmt.Sprintf(`<a href="http://%s/"></a>`, kept) {
+		t.Fatalf("runtime mapping should use the new rewrite routes, got %s", body)
+	}
+}
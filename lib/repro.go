@@ -1,56 +1,348 @@
 package lib
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
 )
 
+var errShuttingDown = errors.New("shutting down")
+
 type Repro struct {
-	proxies []*ProxyServer
-	log     io.Writer
+	cfg          Config
+	proxies      []*ProxyServer
+	virtualHosts []*VirtualHostServer
+	registry     *mappingRegistry
+	log          io.Writer
+	ca           *CertificateAuthority
+	admin        *adminApi
+	recorder     *harRecorder
+	errors       chan error
+
+	// Guards proxies and virtual hosts, which change at runtime
+	mutex    sync.Mutex
+	stopping bool
 }
 
 func (r *Repro) Start() (err <-chan error) {
-	c := make(chan error, 1)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
 	for _, p := range r.proxies {
-		go func(proxy *ProxyServer) {
-			for err := range proxy.Start() {
-				c <- err
-			}
-		}(p)
+		if p.virtualHostName == "" {
+			r.forward(p.Start())
+		}
+	}
+
+	for _, v := range r.virtualHosts {
+		r.forward(v.Start())
+	}
+
+	if r.admin != nil {
+		r.forward(r.admin.Start())
+	}
+
+	return r.errors
+}
+
+// Serves until the context is done or a server fails, then shuts down all
+// servers and waits up to the drain timeout for active requests to complete
+func (r *Repro) Run(ctx context.Context, drainTimeout time.Duration) (err error) {
+	select {
+	case err = <-r.Start():
+	case <-ctx.Done():
+	}
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	if e := r.Shutdown(drainCtx); err == nil {
+		err = e
+	}
+
+	return
+}
+
+// Stops all servers, including those started at runtime, and waits for active
+// requests to complete. Connections that are still active when the context is
+// done are closed.
+func (r *Repro) Shutdown(ctx context.Context) (err error) {
+	r.mutex.Lock()
+	r.stopping = true
+	proxies := r.proxies
+	virtualHosts := r.virtualHosts
+	r.mutex.Unlock()
+
+	var shutdowns []func(context.Context) error
+
+	for _, p := range proxies {
+		if p.virtualHostName == "" {
+			shutdowns = append(shutdowns, p.Shutdown)
+		}
+	}
+
+	for _, v := range virtualHosts {
+		shutdowns = append(shutdowns, v.Shutdown)
+	}
+
+	if r.admin != nil {
+		shutdowns = append(shutdowns, r.admin.server.Shutdown)
+	}
+
+	results := make(chan error, len(shutdowns))
+
+	// All servers drain at the same time
+	for _, shutdown := range shutdowns {
+		go func(shutdown func(context.Context) error) {
+			results <- shutdown(ctx)
+		}(shutdown)
 	}
 
-	return c
+	for range shutdowns {
+		if e := <-results; e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if r.recorder != nil {
+		r.recorder.Close()
+	}
+
+	fmt.Fprintln(r.log, "shut down all proxies")
+
+	return
+}
+
+// Each server reports a single error once it stops. Servers that have been
+// shut down on purpose are no error, and only the first failure is reported.
+func (r *Repro) forward(errors <-chan error) {
+	go func() {
+		if err := <-errors; err != http.ErrServerClosed {
+			select {
+			case r.errors <- err:
+			default:
+			}
+		}
+	}()
 }
 
 func NewRepro(cfg Config) (r *Repro, err error) {
 	r = &Repro{
-		log: cfg.log,
+		cfg:    cfg,
+		log:    cfg.log,
+		errors: make(chan error, 1),
+	}
+
+	if cfg.usesLocalTLS() {
+		r.ca, err = LoadOrCreateCertificateAuthority(cfg.caDir)
+
+		if err != nil {
+			return
+		}
+
+		fmt.Fprintf(r.log, "using CA certificate from %s\n", cfg.caDir)
+	}
+
+	mappings, err := virtualHostMappings(cfg.mappings, cfg.virtualHosting)
+
+	if err != nil {
+		return
 	}
 
-	locationRewriter := NewLocationRewriter()
-	refererRewriter := NewRefererRewriter()
-	corsRewriter := NewCorsRewriter()
-	genericResponseRewriter := NewGenericResponseRewriter(cfg.rewriteRoutes)
-	jsonRewriter := NewJsonRewriter(cfg.rewriteRoutes)
+	r.registry = newMappingRegistry(mappings)
+	r.registry.wildcards = cfg.wildcardMappings
+	r.registry.allocate = r.allocateMapping
+
+	if cfg.discovery {
+		r.registry.discovery = &hostDiscovery{
+			allowlist: cfg.discoveryAllowlist,
+			ports:     cfg.discoveryPorts,
+			log:       r.log,
+		}
+	}
+
+	if cfg.adminAddress != "" {
+		r.admin = newAdminApi(r, cfg.adminAddress)
+	}
+
+	if cfg.recordingDir != "" {
+		r.recorder, err = newHarRecorder(cfg.recordingDir, cfg.recordingMaxSize, r.log)
+
+		if err != nil {
+			return
+		}
+	}
 
-	for _, m := range cfg.mappings {
-		proxyServer, e := NewProxyServer(m, cfg.mappings, r.log, cfg.sslAllowInsecure)
+	for _, m := range mappings {
+		proxyServer, e := r.newProxyServer(cfg, m)
 
 		if e != nil {
 			err = e
 			return
 		}
 
-		proxyServer.AddRewriter(locationRewriter)
-		proxyServer.AddRewriter(refererRewriter)
-		proxyServer.AddRewriter(corsRewriter)
-		proxyServer.AddRewriter(genericResponseRewriter)
-		proxyServer.AddRewriter(jsonRewriter)
+		r.proxies = append(r.proxies, proxyServer)
+
+		if m.virtualHost != "" {
+			v, _ := r.virtualHost(m)
+			v.AddProxy(proxyServer)
+		}
+	}
 
-		proxyServer.SetNoLogging(cfg.noLogging)
+	return
+}
 
-		r.proxies = append(r.proxies, proxyServer)
+// Finds or creates the server of a virtual host. The caller holds the lock.
+func (r *Repro) virtualHost(m Mapping) (v *VirtualHostServer, created bool) {
+	for _, v = range r.virtualHosts {
+		if v.local == m.local {
+			return
+		}
+	}
+
+	v = NewVirtualHostServer(m.local, m.localTLS, m.virtualHost, r.log)
+	r.virtualHosts = append(r.virtualHosts, v)
+
+	if r.ca != nil {
+		v.SetCertificateAuthority(r.ca)
+	}
+
+	return v, true
+}
+
+func (r *Repro) newProxyServer(cfg Config, m Mapping) (p *ProxyServer, err error) {
+	settings := cfg.proxySettings(m)
+
+	p, err = NewProxyServer(m, nil, r.log, settings.sslAllowInsecure)
+
+	if err != nil {
+		return
+	}
+
+	p.registry = r.registry
+	p.recorder = r.recorder
+
+	for _, name := range RewriterNames {
+		if settings.enables(name) {
+			p.AddRewriter(newRewriter(name, cfg, settings))
+		}
+	}
+
+	p.SetNoLogging(settings.noLogging)
+	p.SetTimeout(settings.timeout)
+	p.SetRequestHeaders(settings.requestHeaders)
+	p.SetOnboarding(cfg.onboarding)
+	p.SetRewriteWebsockets(cfg.rewriteWebsockets)
+
+	if r.ca != nil {
+		p.SetCertificateAuthority(r.ca)
+	}
+
+	return
+}
+
+// Serves a remote on the first free port of the range. Called by the
+// registry, which is locked meanwhile.
+func (r *Repro) allocateMapping(ports *portRange, remote string) (m Mapping, err error) {
+	for port := ports.firstPort; port <= ports.lastPort; port++ {
+		local := fmt.Sprintf("%s:%d", ports.host, port)
+
+		if r.registry.usesLocal(local) {
+			continue
+		}
+
+		listener, e := net.Listen("tcp", local)
+
+		if e != nil {
+			continue
+		}
+
+		m = Mapping{
+			local:    local,
+			remote:   remote,
+			localTLS: ports.localTLS,
+		}
+
+		_, err = r.startMapping(m, listener)
+
+		return
+	}
+
+	err = errors.New(fmt.Sprintf("%s: no free port left for %s", ports, remote))
+	fmt.Fprintf(r.log, "%v\n", err)
+
+	return
+}
+
+// Serves a mapping that is added at runtime on an open listener
+func (r *Repro) startMapping(m Mapping, listener net.Listener) (p *ProxyServer, err error) {
+	p, err = r.newProxyServer(r.cfg, m)
+
+	if err != nil {
+		listener.Close()
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.stopping {
+		listener.Close()
+		err = errShuttingDown
+		return
+	}
+
+	r.proxies = append(r.proxies, p)
+
+	r.forward(p.serve(listener))
+
+	return
+}
+
+// The available rewriters in the order in which they are applied
+var RewriterNames = []string{
+	"location", "referer", "request-url", "cors", "cookie", "security-headers",
+	"custom-headers", "generic", "json", "html", "css", "sse", "form", "multipart",
+	"rules",
+}
+
+func newRewriter(name string, cfg Config, settings proxySettings) (r Rewriter) {
+	switch name {
+	case "location":
+		r = NewLocationRewriter()
+	case "referer":
+		r = NewRefererRewriter()
+	case "request-url":
+		r = NewRequestUrlRewriter()
+	case "cors":
+		r = NewCorsRewriter()
+	case "cookie":
+		r = NewCookieRewriter(cfg.scopeCookieDomain)
+	case "security-headers":
+		r = NewSecurityHeaderRewriter(cfg.stripHsts)
+	case "custom-headers":
+		r = NewCustomHeaderRewriter(settings.rewriteHeaders, settings.rewriteIncomingHeaders)
+	case "generic":
+		r = NewGenericResponseRewriter(settings.rewriteRoutes)
+	case "json":
+		r = NewJsonRewriter(settings.rewriteRoutes)
+	case "html":
+		r = NewHtmlRewriter(settings.rewriteRoutes)
+	case "css":
+		r = NewCssRewriter(settings.rewriteRoutes)
+	case "sse":
+		r = NewSseRewriter(settings.rewriteRoutes)
+	case "form":
+		r = NewFormRewriter(settings.rewriteRoutes)
+	case "multipart":
+		r = NewMultipartRewriter(settings.rewriteRoutes)
+	case "rules":
+		r = NewRuleRewriter(cfg.rules)
 	}
 
 	return
@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Values are decoded up to this many times in order to find nested URLs like
+// a redirect_uri within a return_to parameter
+const maxUrlEncodingDepth = 3
+
+type RequestUrlRewriter struct{}
+
+func (r *RequestUrlRewriter) RewriteIncomingUrl(requestUri string, ctx RequestContext) string {
+	rewritten, _ := r.rewriteUrl(requestUri, 0, ctx)
+
+	return rewritten
+}
+
+func (r *RequestUrlRewriter) rewriteUrl(uri string, depth int, ctx RequestContext) (result string, rewritten bool) {
+	path, query := uri, ""
+	hasQuery := false
+
+	if index := strings.Index(uri, "?"); index >= 0 {
+		path, query = uri[:index], uri[index+1:]
+		hasQuery = true
+	}
+
+	if replaced, ok := replaceLocals([]byte(path), ctx); ok {
+		path = string(replaced)
+		rewritten = true
+
+		r.log(depth, "url rewriter: rewrote path", ctx)
+	}
+
+	segments := strings.Split(path, "/")
+
+	for i, segment := range segments {
+		if replaced, ok := r.rewriteValue(segment, url.PathUnescape, url.PathEscape, depth, ctx); ok {
+			segments[i] = replaced
+			rewritten = true
+
+			r.log(depth, "url rewriter: rewrote encoded path segment", ctx)
+		}
+	}
+
+	result = strings.Join(segments, "/")
+
+	if !hasQuery {
+		return
+	}
+
+	// Parameters are rewritten one by one in order to preserve their order and
+	// the encoding of untouched values
+	parameters := strings.Split(query, "&")
+
+	for i, parameter := range parameters {
+		index := strings.Index(parameter, "=")
+		if index < 0 {
+			continue
+		}
+
+		key, value := parameter[:index], parameter[index+1:]
+		replaced, ok := replaceLocals([]byte(value), ctx)
+
+		if ok {
+			value = string(replaced)
+		} else {
+			value, ok = r.rewriteValue(value, url.QueryUnescape, url.QueryEscape, depth, ctx)
+		}
+
+		if ok {
+			parameters[i] = key + "=" + value
+			rewritten = true
+
+			r.log(depth, fmt.Sprintf("url rewriter: rewrote query parameter %s", key), ctx)
+		}
+	}
+
+	result += "?" + strings.Join(parameters, "&")
+
+	return
+}
+
+// Decodes a percent-encoded value and rewrites it as an URL of its own, which
+// covers nested encodings. The result is encoded again.
+func (r *RequestUrlRewriter) rewriteValue(value string, unescape func(string) (string, error), escape func(string) string, depth int, ctx RequestContext) (string, bool) {
+	if depth >= maxUrlEncodingDepth {
+		return value, false
+	}
+
+	decoded, err := unescape(value)
+
+	if err != nil || decoded == value {
+		return value, false
+	}
+
+	if result, ok := r.rewriteUrl(decoded, depth+1, ctx); ok {
+		return escape(result), true
+	}
+
+	return value, false
+}
+
+// Only changes to the request URL itself are logged, not those to nested URLs
+func (r *RequestUrlRewriter) log(depth int, message string, ctx RequestContext) {
+	if depth == 0 {
+		ctx.Log(message)
+	}
+}
+
+func NewRequestUrlRewriter() *RequestUrlRewriter {
+	return &RequestUrlRewriter{}
+}
@@ -0,0 +1,49 @@
+package lib
+
+import (
+	"net/url"
+	"testing"
+)
+
+func assertUrlRewritesTo(t *testing.T, original, expected string) {
+	ctx, err := newMockContext()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rewritten := NewRequestUrlRewriter().RewriteIncomingUrl(original, ctx); rewritten != expected {
+		t.Fatalf("rewrite of %s failed, got %s, expected %s", original, rewritten, expected)
+	}
+}
+
+func TestQueryRewriting(t *testing.T) {
+	assertUrlRewritesTo(t,
+		"/authorize?client_id=x&redirect_uri=http%3A%2F%2F1.2.3.4%3A8888%2Fcb&state=a%2Fb",
+		"/authorize?client_id=x&redirect_uri="+url.QueryEscape("http://foo.bar/cb")+"&state=a%2Fb")
+
+	assertUrlRewritesTo(t,
+		"/login?next=http://4.3.2.1:9999/home&flag",
+		"/login?next=https://bar.baz/home&flag")
+
+	assertUrlRewritesTo(t, "/search?q=1.2.3.4%3A8888", "/search?q=foo.bar")
+	assertUrlRewritesTo(t, "/search?q=1.2.3.4%3A88889", "/search?q=1.2.3.4%3A88889")
+}
+
+func TestNestedQueryRewriting(t *testing.T) {
+	inner := "/authorize?redirect_uri=" + url.QueryEscape("http://1.2.3.4:8888/cb")
+	expected := "/authorize?redirect_uri=" + url.QueryEscape("http://foo.bar/cb")
+
+	assertUrlRewritesTo(t,
+		"/login?return_to="+url.QueryEscape(inner),
+		"/login?return_to="+url.QueryEscape(expected))
+}
+
+func TestPathRewriting(t *testing.T) {
+	assertUrlRewritesTo(t,
+		"/proxy/"+url.PathEscape("http://1.2.3.4:8888/x")+"/raw",
+		"/proxy/"+url.PathEscape("http://foo.bar/x")+"/raw")
+
+	assertUrlRewritesTo(t, "/redirect/http://1.2.3.4:8888/x?a=b", "/redirect/http://foo.bar/x?a=b")
+	assertUrlRewritesTo(t, "/plain/path?x=y", "/plain/path?x=y")
+}
@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	ruleTargetBody   = "body"
+	ruleTargetHeader = "header"
+	ruleTargetJson   = "json"
+)
+
+type RewriteRule struct {
+	name        string
+	route       *regexp.Regexp
+	contentType string
+	target      string
+	header      string
+	jsonPath    []string
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// Targets are "body", "header:<name>" or "json:<path>", with path being a dot
+// separated list of object keys and array indices. "*" matches all keys resp.
+// elements.
+func NewRewriteRule(name, route, contentType, target, pattern, replacement string) (r RewriteRule, err error) {
+	r = RewriteRule{
+		name:        name,
+		contentType: strings.ToLower(strings.TrimSpace(contentType)),
+		replacement: replacement,
+	}
+
+	if route == "" {
+		route = "."
+	}
+
+	r.route, err = regexp.Compile(route)
+
+	if err == nil {
+		r.pattern, err = regexp.Compile(pattern)
+	}
+
+	if err != nil {
+		return
+	}
+
+	parts := strings.SplitN(target, ":", 2)
+	r.target = strings.ToLower(strings.TrimSpace(parts[0]))
+
+	switch {
+	case r.target == "" || r.target == ruleTargetBody && len(parts) == 1:
+		r.target = ruleTargetBody
+
+	case r.target == ruleTargetHeader && len(parts) == 2 && parts[1] != "":
+		r.header = strings.TrimSpace(parts[1])
+
+	case r.target == ruleTargetJson && len(parts) == 2 && parts[1] != "":
+		r.jsonPath = strings.Split(strings.TrimSpace(parts[1]), ".")
+
+	default:
+		err = errors.New(fmt.Sprintf("invalid rule target: %s", target))
+	}
+
+	return
+}
+
+func (r *RewriteRule) description() string {
+	if r.name != "" {
+		return r.name
+	}
+
+	return r.pattern.String()
+}
+
+func (r *RewriteRule) matches(ctx RequestContext) bool {
+	if !r.route.MatchString(ctx.RequestUrl()) {
+		return false
+	}
+
+	if r.contentType == "" {
+		return true
+	}
+
+	mediaType := responseMediaType(ctx)
+
+	if strings.HasSuffix(r.contentType, "/*") {
+		return strings.HasPrefix(mediaType, r.contentType[:len(r.contentType)-1])
+	}
+
+	return mediaType == r.contentType
+}
+
+// Body and JSON path rules need the complete body. Without a content type,
+// they only apply to text resp. JSON, so downloads are not buffered. Event
+// streams never end and are thus left alone.
+func (r *RewriteRule) matchesBody(ctx RequestContext) bool {
+	mediaType := responseMediaType(ctx)
+
+	if mediaType == "text/event-stream" || !r.matches(ctx) {
+		return false
+	}
+
+	if r.contentType != "" {
+		return true
+	}
+
+	if r.target == ruleTargetJson {
+		return isJsonMediaType(mediaType)
+	}
+
+	return isTextMediaType(mediaType)
+}
+
+func isJsonMediaType(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func isTextMediaType(mediaType string) bool {
+	switch mediaType {
+	case "application/javascript", "application/ecmascript", "application/xml", "application/x-www-form-urlencoded":
+		return true
+	}
+
+	return strings.HasPrefix(mediaType, "text/") || isJsonMediaType(mediaType) || strings.HasSuffix(mediaType, "+xml")
+}
+
+func (r *RewriteRule) replace(value []byte) ([]byte, bool) {
+	if !r.pattern.Match(value) {
+		return value, false
+	}
+
+	return r.pattern.ReplaceAll(value, []byte(r.replacement)), true
+}
@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"io"
 	"net/http"
 )
 
@@ -20,9 +21,23 @@ type IncomingHeaderRewriter interface {
 	RewriteIncomingHeaders(headers http.Header, ctx RequestContext)
 }
 
+type IncomingUrlRewriter interface {
+	RewriteIncomingUrl(requestUri string, ctx RequestContext) string
+}
+
 type BodyRewriter interface {
 	RewriteResponse(response []byte, ctx RequestContext) []byte
 	Matches(ctx RequestContext) bool
 }
 
+type IncomingBodyRewriter interface {
+	RewriteIncomingBody(body []byte, ctx RequestContext) []byte
+	MatchesIncoming(ctx RequestContext) bool
+}
+
+type StreamingBodyRewriter interface {
+	BodyRewriter
+	RewriteResponseStream(response io.Reader, ctx RequestContext) io.Reader
+}
+
 type Rewriter interface{}
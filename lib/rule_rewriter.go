@@ -0,0 +1,244 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+type RuleRewriter struct {
+	rules []RewriteRule
+}
+
+func (r *RuleRewriter) RewriteHeaders(headers http.Header, ctx RequestContext) {
+	for i := range r.rules {
+		rule := &r.rules[i]
+
+		if rule.target != ruleTargetHeader || !rule.matches(ctx) {
+			continue
+		}
+
+		values := headers[http.CanonicalHeaderKey(rule.header)]
+		rewritten := false
+
+		for j, value := range values {
+			if replaced, ok := rule.replace([]byte(value)); ok {
+				values[j] = string(replaced)
+				rewritten = true
+			}
+		}
+
+		if rewritten {
+			ctx.Log(fmt.Sprintf("rule rewriter: applied %s to header %s", rule.description(), rule.header))
+		}
+	}
+}
+
+func (r *RuleRewriter) Matches(ctx RequestContext) bool {
+	for i := range r.rules {
+		if r.rules[i].target != ruleTargetHeader && r.rules[i].matchesBody(ctx) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *RuleRewriter) RewriteResponse(response []byte, ctx RequestContext) []byte {
+	return r.rewriteBody(response, ctx, make([]bool, len(r.rules)))
+}
+
+// Body rules are applied line by line. JSON path rules need the complete body.
+func (r *RuleRewriter) RewriteResponseStream(response io.Reader, ctx RequestContext) io.Reader {
+	stream := &ruleStream{
+		source: bufio.NewReaderSize(response, ruleLineLimit),
+	}
+
+	logged := make([]bool, len(r.rules))
+	stream.rewrite = func(data []byte) []byte {
+		return r.rewriteBody(data, ctx, logged)
+	}
+
+	for i := range r.rules {
+		if r.rules[i].target == ruleTargetJson && r.rules[i].matchesBody(ctx) {
+			stream.complete = true
+		}
+	}
+
+	return stream
+}
+
+// Each applied rule is logged once
+func (r *RuleRewriter) rewriteBody(response []byte, ctx RequestContext, logged []bool) []byte {
+	for i := range r.rules {
+		rule := &r.rules[i]
+
+		if rule.target == ruleTargetHeader || !rule.matchesBody(ctx) {
+			continue
+		}
+
+		rewritten := false
+
+		if rule.target == ruleTargetBody {
+			response, rewritten = rule.replace(response)
+		} else {
+			response, rewritten = r.rewriteJsonPath(response, rule)
+		}
+
+		if rewritten && !logged[i] {
+			ctx.Log(fmt.Sprintf("rule rewriter: applied %s to %s", rule.description(), rule.target))
+			logged[i] = true
+		}
+	}
+
+	return response
+}
+
+// Numbers are kept as they are, as integers beyond 2^53 would lose precision as
+// float64
+func unmarshalJson(data []byte) (value interface{}, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	if err = decoder.Decode(&value); err == nil && decoder.More() {
+		err = errors.New("unexpected data after JSON value")
+	}
+
+	return
+}
+
+func (r *RuleRewriter) rewriteJsonPath(response []byte, rule *RewriteRule) ([]byte, bool) {
+	data, err := unmarshalJson(response)
+
+	if err != nil {
+		return response, false
+	}
+
+	rewritten := false
+	data = r.walkJsonPath(data, rule.jsonPath, rule, &rewritten)
+
+	if !rewritten {
+		return response, false
+	}
+
+	result, err := marshalJson(data)
+
+	if err != nil {
+		return response, false
+	}
+
+	return result, true
+}
+
+func (r *RuleRewriter) walkJsonPath(node interface{}, path []string, rule *RewriteRule, rewritten *bool) interface{} {
+	if len(path) == 0 {
+		return r.replaceJsonValue(node, rule, rewritten)
+	}
+
+	key := path[0]
+
+	switch value := node.(type) {
+	case map[string]interface{}:
+		for k, child := range value {
+			if key == "*" || key == k {
+				value[k] = r.walkJsonPath(child, path[1:], rule, rewritten)
+			}
+		}
+
+	case []interface{}:
+		index, err := strconv.Atoi(key)
+
+		for i, child := range value {
+			if key == "*" || err == nil && index == i {
+				value[i] = r.walkJsonPath(child, path[1:], rule, rewritten)
+			}
+		}
+	}
+
+	return node
+}
+
+// Strings are matched by their value, all other values by their JSON
+// representation. This allows e.g. to flip boolean flags.
+func (r *RuleRewriter) replaceJsonValue(node interface{}, rule *RewriteRule, rewritten *bool) interface{} {
+	if value, ok := node.(string); ok {
+		if replaced, ok := rule.replace([]byte(value)); ok {
+			*rewritten = true
+			return string(replaced)
+		}
+
+		return node
+	}
+
+	encoded, err := marshalJson(node)
+
+	if err != nil {
+		return node
+	}
+
+	replaced, ok := rule.replace(encoded)
+
+	if !ok {
+		return node
+	}
+
+	*rewritten = true
+
+	decoded, err := unmarshalJson(replaced)
+
+	if err != nil {
+		return string(replaced)
+	}
+
+	return decoded
+}
+
+// Longer lines are rewritten in parts
+const ruleLineLimit = 64 * 1024
+
+type ruleStream struct {
+	source   *bufio.Reader
+	rewrite  func([]byte) []byte
+	complete bool
+	output   []byte
+	err      error
+}
+
+func (s *ruleStream) Read(p []byte) (n int, err error) {
+	for len(s.output) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+
+		var data []byte
+
+		if s.complete {
+			if data, s.err = ioutil.ReadAll(s.source); s.err == nil {
+				s.err = io.EOF
+			}
+		} else if data, s.err = s.source.ReadSlice('\n'); s.err == bufio.ErrBufferFull {
+			s.err = nil
+		}
+
+		if len(data) > 0 {
+			s.output = s.rewrite(data)
+		}
+	}
+
+	n = copy(p, s.output)
+	s.output = s.output[n:]
+
+	return
+}
+
+func NewRuleRewriter(rules []RewriteRule) *RuleRewriter {
+	return &RuleRewriter{
+		rules: rules,
+	}
+}
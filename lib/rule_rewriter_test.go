@@ -0,0 +1,284 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newRuleContext(t *testing.T, path, contentType string) *requestContext {
+	ctx := newCookieContext("127.0.0.1:8080", false)
+	ctx.incomingRequest.RequestURI = path
+	ctx.upstreamResponse = &http.Response{
+		Header: http.Header{"Content-Type": []string{contentType}},
+	}
+
+	return ctx
+}
+
+func newRule(t *testing.T, route, contentType, target, pattern, replacement string) RewriteRule {
+	rule, err := NewRewriteRule("", route, contentType, target, pattern, replacement)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rule
+}
+
+func TestBodyRule(t *testing.T) {
+	rewriter := NewRuleRewriter([]RewriteRule{
+		newRule(t, "^http://[^/]+/app", "text/*", "body", `analytics\.([a-z]+)\.com`, "localhost/$1"),
+	})
+
+	ctx := newRuleContext(t, "/app.js", "text/javascript")
+
+	if !rewriter.Matches(ctx) {
+		t.Fatal("rule should match")
+	}
+
+	if rewritten := string(rewriter.RewriteResponse([]byte("load('analytics.foo.com')"), ctx)); rewritten != "load('localhost/foo')" {
+		t.Fatalf("unexpected body %s", rewritten)
+	}
+
+	if rewriter.Matches(newRuleContext(t, "/other.js", "text/javascript")) {
+		t.Fatal("route should not match")
+	}
+
+	if rewriter.Matches(newRuleContext(t, "/app.json", "application/json")) {
+		t.Fatal("content type should not match")
+	}
+}
+
+func TestJsonPathRule(t *testing.T) {
+	rewriter := NewRuleRewriter([]RewriteRule{
+		newRule(t, "", "application/json", "json:features.checkout", "false", "true"),
+		newRule(t, "", "application/json", "json:keys.*.value", "^prod-", "staging-"),
+	})
+
+	ctx := newRuleContext(t, "/config", "application/json")
+
+	original := `{"features":{"checkout":false,"other":false},"keys":[{"value":"prod-1"},{"value":"prod-2"}],"name":"prod-3"}`
+	expected := `{"features":{"checkout":true,"other":false},"keys":[{"value":"staging-1"},{"value":"staging-2"}],"name":"prod-3"}`
+
+	if rewritten := string(rewriter.RewriteResponse([]byte(original), ctx)); rewritten != expected {
+		t.Fatalf("unexpected body %s", rewritten)
+	}
+}
+
+func TestRuleDefaultContentTypes(t *testing.T) {
+	body := newRule(t, "", "", "body", "a", "b")
+	json := newRule(t, "", "", "json:a", "a", "b")
+
+	for mediaType, expected := range map[string][2]bool{
+		"text/plain":             {true, false},
+		"application/javascript": {true, false},
+		"application/json":       {true, true},
+		"application/ld+json":    {true, true},
+		"image/png":              {false, false},
+		"application/zip":        {false, false},
+		"text/event-stream":      {false, false},
+	} {
+		ctx := newRuleContext(t, "/", mediaType)
+
+		if body.matchesBody(ctx) != expected[0] || json.matchesBody(ctx) != expected[1] {
+			t.Fatalf("unexpected match for %s", mediaType)
+		}
+	}
+
+	explicit := newRule(t, "", "application/octet-stream", "body", "a", "b")
+
+	if !explicit.matchesBody(newRuleContext(t, "/", "application/octet-stream")) {
+		t.Fatal("explicit content type should match")
+	}
+}
+
+func TestJsonPathRuleNumbers(t *testing.T) {
+	rewriter := NewRuleRewriter([]RewriteRule{
+		newRule(t, "", "", "json:flag", "false", "true"),
+	})
+
+	ctx := newRuleContext(t, "/config", "application/json")
+
+	original := `{"id":12345678901234567891,"price":1.10,"flag":false,"note":"<b>&</b>"}`
+	expected := `{"flag":true,"id":12345678901234567891,"note":"<b>&</b>","price":1.10}`
+
+	if rewritten := string(rewriter.RewriteResponse([]byte(original), ctx)); rewritten != expected {
+		t.Fatalf("unexpected body %s", rewritten)
+	}
+}
+
+func TestRuleStream(t *testing.T) {
+	rewriter := NewRuleRewriter([]RewriteRule{
+		newRule(t, "", "", "body", "flag=off", "flag=on"),
+	})
+
+	ctx := newRuleContext(t, "/", "text/plain")
+	source, writer := io.Pipe()
+	reader := bufio.NewReader(rewriter.RewriteResponseStream(source, ctx))
+
+	go writer.Write([]byte("first flag=off\nsecond"))
+
+	// The first line is passed on before the body is complete
+	if line, err := reader.ReadString('\n'); err != nil || line != "first flag=on\n" {
+		t.Fatalf("unexpected line %s", line)
+	}
+
+	go func() {
+		writer.Write([]byte(" flag=off"))
+		writer.Close()
+	}()
+
+	if rest, _ := ioutil.ReadAll(reader); string(rest) != "second flag=on" {
+		t.Fatalf("unexpected rest %s", rest)
+	}
+
+	if logs := ctx.logs; len(logs) != 1 {
+		t.Fatalf("rule should be logged once, got %v", logs)
+	}
+}
+
+func TestRuleStreamWithJsonPath(t *testing.T) {
+	rewriter := NewRuleRewriter([]RewriteRule{
+		newRule(t, "", "", "json:flag", "false", "true"),
+	})
+
+	ctx := newRuleContext(t, "/", "application/json")
+	stream := rewriter.RewriteResponseStream(strings.NewReader("{\"flag\":\n false}"), ctx)
+
+	if rewritten, _ := ioutil.ReadAll(stream); string(rewritten) != `{"flag":true}` {
+		t.Fatalf("unexpected body %s", rewritten)
+	}
+}
+
+func TestRulesWithEventStream(t *testing.T) {
+	release := make(chan bool)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/event-stream")
+		fmt.Fprint(w, "data: flag=off\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer upstream.Close()
+
+	proxy := httptest.NewUnstartedServer(nil)
+
+	local, _ := NewMapping(proxy.Listener.Addr().String(), upstream.URL)
+
+	p, err := NewProxyServer(local, []Mapping{local}, ioutil.Discard, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.AddRewriter(NewRuleRewriter([]RewriteRule{
+		newRule(t, "", "", "body", "flag=off", "flag=on"),
+	}))
+
+	proxy.Config.Handler = p
+	proxy.Start()
+	defer proxy.Close()
+
+	// Runs first, so the servers can be closed
+	defer close(release)
+
+	events := make(chan string, 1)
+	go func() {
+		response, err := http.Get(proxy.URL + "/")
+
+		if err != nil {
+			events <- err.Error()
+			return
+		}
+
+		defer response.Body.Close()
+
+		event, _ := bufio.NewReader(response.Body).ReadString('\n')
+		events <- event
+	}()
+
+	select {
+	case event := <-events:
+		if event != "data: flag=off\n" {
+			t.Fatalf("unexpected event %s", event)
+		}
+
+	case <-time.After(2 * time.Second):
+		t.Fatal("event stream was buffered")
+	}
+}
+
+func TestInvalidRules(t *testing.T) {
+	if _, err := NewRewriteRule("", "(", "", "body", "a", "b"); err == nil {
+		t.Fatal("invalid route accepted")
+	}
+
+	if _, err := NewRewriteRule("", "", "", "cookie:x", "a", "b"); err == nil {
+		t.Fatal("invalid target accepted")
+	}
+
+	if _, err := NewRewriteRule("", "", "", "json:", "a", "b"); err == nil {
+		t.Fatal("empty json path accepted")
+	}
+}
+
+func TestRulesInProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/plain")
+		w.Header().Set("x-api-key", "prod-key")
+		fmt.Fprint(w, "flag=off")
+	}))
+	defer upstream.Close()
+
+	proxy := httptest.NewUnstartedServer(nil)
+
+	local, _ := NewMapping(proxy.Listener.Addr().String(), upstream.URL)
+
+	p, err := NewProxyServer(local, []Mapping{local}, ioutil.Discard, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.AddRewriter(NewRuleRewriter([]RewriteRule{
+		newRule(t, "", "", "body", "flag=off", "flag=on"),
+		newRule(t, "", "", "header:x-api-key", "^prod-", "staging-"),
+	}))
+
+	proxy.Config.Handler = p
+	proxy.Start()
+	defer proxy.Close()
+
+	response, err := http.Get(proxy.URL + "/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	if string(body) != "flag=on" {
+		t.Fatalf("unexpected body %s", body)
+	}
+
+	if key := response.Header.Get("x-api-key"); key != "staging-key" {
+		t.Fatalf("unexpected header %s", key)
+	}
+
+	// Body rules are streamed, so they are logged in the trailers
+	logs := append(response.Header["X-Go-Repro-Log"], response.Trailer["X-Go-Repro-Log"]...)
+
+	if log := strings.Join(logs, "|"); !strings.Contains(log, "rule rewriter: applied flag=off to body") ||
+		!strings.Contains(log, "rule rewriter: applied ^prod- to header x-api-key") {
+
+		t.Fatalf("rules missing from log: %s", log)
+	}
+}
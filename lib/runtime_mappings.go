@@ -0,0 +1,188 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const DefaultDrainTimeout = 10 * time.Second
+
+type MappingState struct {
+	Local       string `json:"local"`
+	Remote      string `json:"remote"`
+	State       string `json:"state"`
+	VirtualHost string `json:"virtual_host,omitempty"`
+}
+
+func proxyState(p *ProxyServer) (s MappingState) {
+	s = MappingState{
+		Local:  p.local,
+		Remote: p.remote,
+		State:  p.State(),
+	}
+
+	if p.localTLS {
+		s.Local = "https://" + s.Local
+	}
+
+	if p.virtualHostPath != "" {
+		s.VirtualHost = p.virtualHostPath
+	} else {
+		s.VirtualHost = p.virtualHostName
+	}
+
+	return
+}
+
+// All mappings, including those that are currently shutting down
+func (r *Repro) MappingStates() []MappingState {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	states := make([]MappingState, 0, len(r.proxies))
+
+	for _, p := range r.proxies {
+		states = append(states, proxyState(p))
+	}
+
+	return states
+}
+
+// Starts serving a new mapping with the global options
+func (r *Repro) AddMapping(local, remote string) (state MappingState, err error) {
+	m, err := NewMapping(local, remote)
+
+	if err != nil {
+		return
+	}
+
+	// The CA is only set up on startup
+	if m.localTLS && r.ca == nil {
+		err = errors.New("adding the first https mapping requires a restart")
+		return
+	}
+
+	r.registry.mutex.Lock()
+	defer r.registry.mutex.Unlock()
+
+	if r.registry.usesLocal(m.local) {
+		err = errors.New(fmt.Sprintf("%s: local address is already in use", m.local))
+		return
+	}
+
+	listener, err := net.Listen("tcp", m.local)
+
+	if err != nil {
+		return
+	}
+
+	p, err := r.startMapping(m, listener)
+
+	if err != nil {
+		return
+	}
+
+	r.registry.add(m)
+	state = proxyState(p)
+
+	return
+}
+
+// Removes a mapping from all proxies and shuts it down once active requests
+// are complete. The remote is only needed for virtual hosts.
+func (r *Repro) RemoveMapping(local, remote string) (err error) {
+	address, _, err := parseLocal(local)
+
+	if err != nil {
+		return
+	}
+
+	m, err := r.registry.remove(address, remote)
+
+	if err != nil {
+		return
+	}
+
+	var proxy *ProxyServer
+	var virtualHost *VirtualHostServer
+
+	r.mutex.Lock()
+
+	for _, p := range r.proxies {
+		if p.local == m.local && p.remote == m.remote {
+			proxy = p
+		}
+	}
+
+	for _, v := range r.virtualHosts {
+		if v.local == m.local {
+			virtualHost = v
+		}
+	}
+
+	r.mutex.Unlock()
+
+	if proxy == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.drainTimeout())
+	defer cancel()
+
+	if proxy.virtualHostName == "" {
+		err = proxy.Shutdown(ctx)
+	} else if virtualHost != nil {
+		proxy.setState(proxyStopping)
+		proxy.websockets.closeAll()
+
+		// The listener is shared, so it is only closed with the last mapping
+		if virtualHost.RemoveProxy(proxy) == 0 {
+			err = virtualHost.Shutdown(ctx)
+			r.removeVirtualHost(virtualHost)
+		}
+
+		proxy.closeIdleConnections()
+		proxy.setState(proxyStopped)
+	}
+
+	r.removeProxy(proxy)
+
+	fmt.Fprintf(r.log, "stopped proxying requests for %s to %s\n", m.local, m.remote)
+
+	return
+}
+
+func (r *Repro) removeProxy(proxy *ProxyServer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for i, p := range r.proxies {
+		if p == proxy {
+			r.proxies = append(r.proxies[:i:i], r.proxies[i+1:]...)
+			return
+		}
+	}
+}
+
+func (r *Repro) removeVirtualHost(virtualHost *VirtualHostServer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for i, v := range r.virtualHosts {
+		if v == virtualHost {
+			r.virtualHosts = append(r.virtualHosts[:i:i], r.virtualHosts[i+1:]...)
+			return
+		}
+	}
+}
+
+// The config is swapped on reloads, which lock the registry
+func (r *Repro) drainTimeout() time.Duration {
+	r.registry.mutex.RLock()
+	defer r.registry.mutex.RUnlock()
+
+	return r.cfg.drainTimeout
+}
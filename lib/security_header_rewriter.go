@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var cspHeaders = []string{"content-security-policy", "content-security-policy-report-only"}
+
+var reportingHeaders = []string{"report-to", "reporting-endpoints", "nel"}
+
+type SecurityHeaderRewriter struct {
+	stripHsts bool
+}
+
+func (r *SecurityHeaderRewriter) RewriteHeaders(headers http.Header, ctx RequestContext) {
+	secure := strings.HasPrefix(ctx.RequestUrl(), "https://")
+	matcher := newRemoteHostMatcher(ctx, true)
+
+	for _, key := range cspHeaders {
+		values := headers[http.CanonicalHeaderKey(key)]
+
+		for i, value := range values {
+			if policy, ok := r.rewritePolicy(value, secure, matcher); ok {
+				values[i] = policy
+				ctx.Log(fmt.Sprintf("security header rewriter: rewrote %s", key))
+			}
+		}
+	}
+
+	// Endpoints are URLs, possibly within JSON
+	urlMatcher := newRemoteHostMatcher(ctx, false)
+
+	for _, key := range reportingHeaders {
+		values := headers[http.CanonicalHeaderKey(key)]
+
+		for i, value := range values {
+			if rewritten, ok := urlMatcher.replaceString(value); ok {
+				values[i] = rewritten
+				ctx.Log(fmt.Sprintf("security header rewriter: rewrote %s", key))
+			}
+		}
+	}
+
+	if r.stripHsts && headers.Get("strict-transport-security") != "" {
+		headers.Del("strict-transport-security")
+		ctx.Log("security header rewriter: removed strict-transport-security")
+	}
+}
+
+func (r *SecurityHeaderRewriter) rewritePolicy(policy string, secure bool, matcher *hostMatcher) (string, bool) {
+	directives := strings.Split(policy, ";")
+	result := make([]string, 0, len(directives))
+	rewritten := false
+
+	for _, directive := range directives {
+		tokens := strings.Fields(directive)
+
+		if len(tokens) == 0 {
+			continue
+		}
+
+		name := strings.ToLower(tokens[0])
+
+		// These would break all requests to plain http mappings
+		if !secure && (name == "upgrade-insecure-requests" || name == "block-all-mixed-content") {
+			rewritten = true
+			continue
+		}
+
+		for i, source := range tokens[1:] {
+			// Keywords, nonces and hashes
+			if strings.HasPrefix(source, "'") {
+				continue
+			}
+
+			if mapped, ok := matcher.replaceString(source); ok {
+				tokens[i+1] = mapped
+				rewritten = true
+			}
+		}
+
+		result = append(result, strings.Join(tokens, " "))
+	}
+
+	if !rewritten {
+		return policy, false
+	}
+
+	return strings.Join(result, "; "), true
+}
+
+func NewSecurityHeaderRewriter(stripHsts bool) *SecurityHeaderRewriter {
+	return &SecurityHeaderRewriter{
+		stripHsts: stripHsts,
+	}
+}
@@ -0,0 +1,76 @@
+package lib
+
+import (
+	"net/http"
+	"testing"
+)
+
+func newSecurityHeaderContext(t *testing.T, secure bool) *requestContext {
+	mappings, err := newMockContext()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := newCookieContext("127.0.0.1:8080", secure)
+	ctx.hostMappings = mappings
+
+	return ctx
+}
+
+func TestContentSecurityPolicy(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("content-security-policy",
+		"default-src 'self'; connect-src https://bar.baz http://foo.bar/api 'nonce-abc'; img-src bar.baz *.bar.baz; upgrade-insecure-requests")
+	headers.Set("content-security-policy-report-only", "script-src 'self'; report-uri https://bar.baz/csp")
+
+	NewSecurityHeaderRewriter(false).RewriteHeaders(headers, newSecurityHeaderContext(t, false))
+
+	expected := "default-src 'self'; connect-src http://4.3.2.1:9999 http://1.2.3.4:8888/api 'nonce-abc'; img-src 4.3.2.1:9999 *.bar.baz"
+	if policy := headers.Get("content-security-policy"); policy != expected {
+		t.Fatalf("unexpected policy %s", policy)
+	}
+
+	expected = "script-src 'self'; report-uri http://4.3.2.1:9999/csp"
+	if policy := headers.Get("content-security-policy-report-only"); policy != expected {
+		t.Fatalf("unexpected report-only policy %s", policy)
+	}
+}
+
+func TestContentSecurityPolicyOverHttps(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("content-security-policy", "default-src 'self'; upgrade-insecure-requests")
+
+	NewSecurityHeaderRewriter(false).RewriteHeaders(headers, newSecurityHeaderContext(t, true))
+
+	if policy := headers.Get("content-security-policy"); policy != "default-src 'self'; upgrade-insecure-requests" {
+		t.Fatalf("policy should not have been touched, got %s", policy)
+	}
+}
+
+func TestReportingHeaders(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("report-to", `{"group":"default","max_age":3600,"endpoints":[{"url":"https:\/\/bar.baz\/reports"}]}`)
+	headers.Set("reporting-endpoints", `default="https://bar.baz/reports"`)
+	headers.Set("strict-transport-security", "max-age=31536000")
+
+	NewSecurityHeaderRewriter(false).RewriteHeaders(headers, newSecurityHeaderContext(t, true))
+
+	if value := headers.Get("report-to"); value != `{"group":"default","max_age":3600,"endpoints":[{"url":"http:\/\/4.3.2.1:9999\/reports"}]}` {
+		t.Fatalf("unexpected report-to %s", value)
+	}
+
+	if value := headers.Get("reporting-endpoints"); value != `default="http://4.3.2.1:9999/reports"` {
+		t.Fatalf("unexpected reporting-endpoints %s", value)
+	}
+
+	if headers.Get("strict-transport-security") == "" {
+		t.Fatal("hsts should only be removed if configured")
+	}
+
+	NewSecurityHeaderRewriter(true).RewriteHeaders(headers, newSecurityHeaderContext(t, true))
+
+	if headers.Get("strict-transport-security") != "" {
+		t.Fatal("hsts not removed")
+	}
+}
@@ -0,0 +1,102 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"regexp"
+)
+
+type SseRewriter struct {
+	rewriteRoutes []*regexp.Regexp
+}
+
+// Reads a server-sent event stream event by event and rewrites the data lines
+// of each event before passing it on
+type sseReader struct {
+	source    *bufio.Reader
+	output    []byte
+	err       error
+	ctx       RequestContext
+	rewritten bool
+}
+
+func (r *SseRewriter) Matches(ctx RequestContext) bool {
+	if responseMediaType(ctx) != "text/event-stream" {
+		return false
+	}
+
+	return matchesRewriteRoutes(r.rewriteRoutes, ctx.RequestUrl())
+}
+
+func (r *SseRewriter) RewriteResponse(response []byte, ctx RequestContext) []byte {
+	rewritten, err := ioutil.ReadAll(r.RewriteResponseStream(bytes.NewReader(response), ctx))
+
+	if err != nil {
+		return response
+	}
+
+	return rewritten
+}
+
+func (r *SseRewriter) RewriteResponseStream(response io.Reader, ctx RequestContext) io.Reader {
+	return &sseReader{
+		source: bufio.NewReader(response),
+		ctx:    ctx,
+	}
+}
+
+func (r *sseReader) Read(p []byte) (n int, err error) {
+	for len(r.output) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		r.readEvent()
+	}
+
+	n = copy(p, r.output)
+	r.output = r.output[n:]
+
+	return
+}
+
+func (r *sseReader) readEvent() {
+	var event []byte
+
+	for {
+		line, err := r.source.ReadBytes('\n')
+
+		if bytes.HasPrefix(line, []byte("data:")) {
+			if rewritten, ok := replaceRemotes(line, r.ctx); ok {
+				line = rewritten
+
+				if !r.rewritten {
+					r.ctx.Log("sse rewriter: events rewritten")
+					r.rewritten = true
+				}
+			}
+		}
+
+		event = append(event, line...)
+
+		if err != nil {
+			r.err = err
+			break
+		}
+
+		// An empty line terminates the event
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+	}
+
+	r.output = event
+}
+
+func NewSseRewriter(rewriteRoutes []*regexp.Regexp) *SseRewriter {
+	return &SseRewriter{
+		rewriteRoutes: rewriteRoutes,
+	}
+}
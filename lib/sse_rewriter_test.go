@@ -0,0 +1,82 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSseEvents(t *testing.T) {
+	ctx, err := newMockContext()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := "event: link\ndata: http://foo.bar/x\nid: http://foo.bar\n\ndata: https://bar.baz\r\n\r\n"
+	expected := "event: link\ndata: http://1.2.3.4:8888/x\nid: http://foo.bar\n\ndata: http://4.3.2.1:9999\r\n\r\n"
+
+	if rewritten := string(NewSseRewriter(nil).RewriteResponse([]byte(original), ctx)); rewritten != expected {
+		t.Fatalf("rewrite failed, got %q, expected %q", rewritten, expected)
+	}
+}
+
+func TestSseFlushing(t *testing.T) {
+	release := make(chan struct{})
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/event-stream")
+
+		fmt.Fprint(w, "data: http://foo.bar/1\n\n")
+		w.(http.Flusher).Flush()
+
+		<-release
+
+		fmt.Fprint(w, "data: http://foo.bar/2\n\n")
+	}))
+	defer upstream.Close()
+
+	proxy := httptest.NewUnstartedServer(nil)
+
+	local, _ := NewMapping(proxy.Listener.Addr().String(), upstream.URL)
+	foo, _ := NewMapping("127.0.0.1:8081", "http://foo.bar")
+
+	p, err := NewProxyServer(local, []Mapping{local, foo}, ioutil.Discard, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := NewConfig()
+	config.AddRewriteRoute(".")
+	p.AddRewriter(NewSseRewriter(config.rewriteRoutes))
+
+	proxy.Config.Handler = p
+	proxy.Start()
+	defer proxy.Close()
+
+	// Unblock the upstream before shutting down the servers
+	defer close(release)
+
+	response, err := http.Get(proxy.URL + "/events")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer response.Body.Close()
+
+	// The first event must arrive while the upstream is still blocked
+	line, err := bufio.NewReader(response.Body).ReadString('\n')
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if line != "data: http://127.0.0.1:8081/1\n" {
+		t.Fatalf("unexpected event data %q", line)
+	}
+}
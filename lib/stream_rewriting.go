@@ -0,0 +1,125 @@
+package lib
+
+import (
+	"io"
+)
+
+const streamChunkSize = 32 * 1024
+
+// An io.Reader that replaces the origins known to a hostMatcher in the source
+// stream. Matches that span read boundaries are found by holding back the end
+// of each chunk until enough data is available to decide on them, so memory is
+// bounded by the chunk size plus the longest possible match.
+type streamReplacer struct {
+	source    io.Reader
+	matcher   *hostMatcher
+	window    []byte
+	pos       int
+	output    []byte
+	chunk     []byte
+	err       error
+	onReplace func()
+}
+
+func newStreamReplacer(source io.Reader, matcher *hostMatcher, onReplace func()) *streamReplacer {
+	return &streamReplacer{
+		source:    source,
+		matcher:   matcher,
+		chunk:     make([]byte, streamChunkSize),
+		onReplace: onReplace,
+	}
+}
+
+func (s *streamReplacer) Read(p []byte) (n int, err error) {
+	for len(s.output) == 0 {
+		if s.err != nil && s.pos == len(s.window) {
+			return 0, s.err
+		}
+
+		if s.err == nil {
+			s.fill()
+		}
+
+		s.process()
+	}
+
+	n = copy(p, s.output)
+	s.output = s.output[n:]
+
+	return
+}
+
+func (s *streamReplacer) fill() {
+	n, err := s.source.Read(s.chunk)
+
+	s.window = append(s.window, s.chunk[:n]...)
+
+	if err != nil {
+		s.err = err
+	}
+}
+
+func (s *streamReplacer) process() {
+	// Hosts starting before hostLimit can be decided on, and the prefix of any
+	// host after it starts behind emitLimit
+	hostLimit := len(s.window) - s.matcher.maxSuffixLength
+	emitLimit := hostLimit - s.matcher.maxPrefixLength
+
+	if s.err != nil {
+		hostLimit, emitLimit = len(s.window), len(s.window)
+	}
+
+	if hostLimit <= s.pos {
+		return
+	}
+
+	output, end, count := s.matcher.replaceUntil(s.window, s.pos, hostLimit)
+
+	if emitLimit > end {
+		output = append(output, s.window[end:emitLimit]...)
+		end = emitLimit
+	}
+
+	if count > 0 && s.onReplace != nil {
+		s.onReplace()
+	}
+
+	s.output = output
+
+	// Keep some of the emitted data, it is needed for matching prefixes
+	discard := end - s.matcher.maxPrefixLength
+	if discard < 0 {
+		discard = 0
+	}
+
+	s.window = append(s.window[:0], s.window[discard:]...)
+	s.pos = end - discard
+}
+
+// Runs a rewrite function that writes its output to an io.Writer in a separate
+// goroutine and exposes the output as an io.Reader. The reader must be closed
+// by the consumer in order to terminate the goroutine on early exit.
+func pipeRewrite(rewrite func(io.Writer) error) io.ReadCloser {
+	reader, writer := io.Pipe()
+
+	go func() {
+		writer.CloseWithError(rewrite(writer))
+	}()
+
+	return reader
+}
+
+// The rewritten body as assembled from a chain of streaming rewriters. Closing
+// it closes all intermediate readers.
+type streamingBody struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (b *streamingBody) Close() error {
+	for _, closer := range b.closers {
+		closer.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestStreamReplacerBoundaries(t *testing.T) {
+	ctx, err := newMockContext()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := strings.Repeat("abc http://foo.bar/x http://foo.barbaz http%3A%2F%2Ffoo.bar%2F //bar.baz foo.bar. ", 1000)
+	expected := strings.Repeat("abc http://1.2.3.4:8888/x http://foo.barbaz http%3A%2F%2F1.2.3.4%3A8888%2F //4.3.2.1:9999 1.2.3.4:8888. ", 1000)
+
+	matcher := newRemoteHostMatcher(ctx, true)
+
+	for _, chunked := range []bool{false, true} {
+		var source = strings.NewReader(original)
+		reader := newStreamReplacer(source, matcher, nil)
+
+		if chunked {
+			reader = newStreamReplacer(iotest.OneByteReader(source), matcher, nil)
+		}
+
+		rewritten, err := ioutil.ReadAll(iotest.HalfReader(reader))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(rewritten) != expected {
+			t.Fatalf("stream replacement failed (chunked: %v)", chunked)
+		}
+	}
+}
+
+func TestHtmlStream(t *testing.T) {
+	ctx, err := newMockContext()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := `<html><body><a href="http://foo.bar/x">http://foo.bar/x</a><script>var u = "https://bar.baz";</script></body></html>`
+	rewriter := NewHtmlRewriter(nil)
+
+	expected := rewriter.RewriteResponse([]byte(original), ctx)
+	streamed, err := ioutil.ReadAll(rewriter.RewriteResponseStream(iotest.OneByteReader(strings.NewReader(original)), ctx))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(streamed, expected) {
+		t.Fatalf("streamed rewrite differs, got %s, expected %s", streamed, expected)
+	}
+}
+
+func TestStreamingProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/plain")
+		w.Header().Set("content-length", "22")
+		fmt.Fprint(w, "see http://foo.bar/baz")
+	}))
+	defer upstream.Close()
+
+	local, err := NewMapping("127.0.0.1:8080", upstream.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	foo, err := NewMapping("127.0.0.1:8081", "http://foo.bar")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewProxyServer(local, []Mapping{local, foo}, ioutil.Discard, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := NewConfig()
+	config.AddRewriteRoute(".")
+	p.AddRewriter(NewGenericResponseRewriter(config.rewriteRoutes))
+
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Host = "127.0.0.1:8080"
+
+	response := httptest.NewRecorder()
+	p.ServeHTTP(response, request)
+
+	result := response.Result()
+
+	if body := response.Body.String(); body != "see http://127.0.0.1:8081/baz" {
+		t.Fatalf("body not rewritten: %s", body)
+	}
+
+	if result.Header.Get("content-length") != "" {
+		t.Fatal("streamed response should not have a content length")
+	}
+
+	if result.Trailer.Get("x-go-repro-log") != "generic body rewriter: body rewritten" {
+		t.Fatalf("rewrite log missing from trailers: %v", result.Trailer)
+	}
+}
+
+func TestStreamingWithoutPrescan(t *testing.T) {
+	// Only HTML and CSS may declare their charset in the document
+	for _, contentType := range []string{"text/plain; charset=utf-8", "text/plain", "text/javascript"} {
+		t.Run(contentType, func(t *testing.T) {
+			assertStreamedWithoutPrescan(t, contentType)
+		})
+	}
+}
+
+func assertStreamedWithoutPrescan(t *testing.T, contentType string) {
+	release := make(chan bool)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", contentType)
+		fmt.Fprint(w, "first http://foo.bar/x\n"+strings.Repeat("-", 200))
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, "second")
+	}))
+	defer upstream.Close()
+
+	local, err := NewMapping("127.0.0.1:8080", upstream.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	foo, err := NewMapping("127.0.0.1:8081", "http://foo.bar")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewProxyServer(local, []Mapping{local, foo}, ioutil.Discard, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := NewConfig()
+	config.AddRewriteRoute(".")
+	p.AddRewriter(NewGenericResponseRewriter(config.rewriteRoutes))
+
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	// Runs first, so the servers can be closed
+	defer close(release)
+
+	lines := make(chan string, 1)
+	go func() {
+		response, err := http.Get(proxy.URL + "/")
+
+		if err != nil {
+			lines <- err.Error()
+			return
+		}
+
+		defer response.Body.Close()
+
+		line, _ := bufio.NewReader(response.Body).ReadString('\n')
+		lines <- line
+	}()
+
+	// The first line must arrive although the charset prescan would wait for
+	// more data
+	select {
+	case line := <-lines:
+		if line != "first http://127.0.0.1:8081/x\n" {
+			t.Fatalf("unexpected line %s", line)
+		}
+
+	case <-time.After(2 * time.Second):
+		t.Fatal("response was held back")
+	}
+}
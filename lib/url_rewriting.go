@@ -0,0 +1,209 @@
+package lib
+
+import (
+	"mime"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+func matchesRewriteRoutes(routes []*regexp.Regexp, url string) bool {
+	for _, route := range routes {
+		if route.MatchString(url) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func responseMediaType(ctx RequestContext) string {
+	response := ctx.UpstreamResponse()
+
+	if response == nil {
+		return ""
+	}
+
+	mediaType, _, err := mime.ParseMediaType(response.Header.Get("content-type"))
+
+	if err != nil {
+		return ""
+	}
+
+	return mediaType
+}
+
+func requestMediaType(ctx RequestContext) string {
+	mediaType, _, err := mime.ParseMediaType(ctx.IncomingRequest().Header.Get("content-type"))
+
+	if err != nil {
+		return ""
+	}
+
+	return mediaType
+}
+
+// The mapping of the upstream that served the current request
+func currentHostMapping(ctx RequestContext) (current HostMapping, ok bool) {
+	requestUrl := ctx.RequestUrl()
+
+	// Virtual hosts distinguished by path share the local origin
+	for _, mapping := range ctx.HostMappings() {
+		if hasUrlPrefix(requestUrl, mapping.local) && (!ok || len(mapping.local) > len(current.local)) {
+			current, ok = mapping, true
+		}
+	}
+
+	return
+}
+
+// The scheme of the upstream that served the current request. Scheme-relative
+// URLs in the response are resolved against it.
+func currentRemoteScheme(ctx RequestContext) string {
+	if mapping, ok := currentHostMapping(ctx); ok {
+		return urlScheme(mapping.remote)
+	}
+
+	return "http"
+}
+
+// Root-relative URLs are resolved against the local side of the current
+// mapping, so path prefixes of the remote are replaced with those of the local
+// side. URLs outside the remote prefix are left alone.
+func rewriteRootRelativeUrl(value string, ctx RequestContext) (string, bool) {
+	if !strings.HasPrefix(value, "/") || strings.HasPrefix(value, "//") {
+		return value, false
+	}
+
+	mapping, ok := currentHostMapping(ctx)
+
+	if !ok {
+		return value, false
+	}
+
+	remotePrefix := urlPathPrefix(mapping.remote)
+
+	if remotePrefix != "" && !hasUrlPrefix(value, remotePrefix) {
+		return value, false
+	}
+
+	rest := value[len(remotePrefix):]
+
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+
+	rewritten := urlPathPrefix(mapping.local) + rest
+
+	return rewritten, rewritten != value
+}
+
+func urlScheme(url string) string {
+	if i := strings.Index(url, "://"); i > 0 {
+		return url[:i]
+	}
+
+	return ""
+}
+
+// Checks whether url starts with prefix, followed by the end of the URL or a
+// delimiter. This prevents http://foo.bar from matching http://foo.bar.baz .
+func hasUrlPrefix(url, prefix string) bool {
+	if len(url) < len(prefix) || !strings.EqualFold(url[:len(prefix)], prefix) {
+		return false
+	}
+
+	if len(url) == len(prefix) {
+		return true
+	}
+
+	switch url[len(prefix)] {
+	case '/', '?', '#':
+		return true
+	}
+
+	return false
+}
+
+// Maps a single URL that refers to a remote host to the corresponding local
+// URL. Absolute, scheme-relative and root-relative URLs are handled,
+// surrounding whitespace is preserved.
+func rewriteRemoteUrl(value string, ctx RequestContext) (rewritten string, ok bool) {
+	trimmed := strings.TrimSpace(value)
+	if trimmed == "" {
+		return value, false
+	}
+
+	leading := value[:strings.Index(value, trimmed)]
+	trailing := value[len(leading)+len(trimmed):]
+
+	absolute := trimmed
+	schemeRelative := strings.HasPrefix(trimmed, "//")
+	if schemeRelative {
+		absolute = currentRemoteScheme(ctx) + ":" + trimmed
+	}
+
+	if local, remote, ok := findRemoteMapping(absolute, ctx); ok {
+		return leading + local + absolute[len(remote):] + trailing, true
+	}
+
+	// Hosts matching a wildcard or the discovery allowlist are mapped on first
+	// sight
+	if resolver, ok := ctx.(hostResolver); ok && resolveRemoteUrl(absolute, resolver) {
+		if local, remote, ok := findRemoteMapping(absolute, ctx); ok {
+			return leading + local + absolute[len(remote):] + trailing, true
+		}
+	}
+
+	if stripped, ok := rewriteRootRelativeUrl(trimmed, ctx); ok {
+		return leading + stripped + trailing, true
+	}
+
+	return value, false
+}
+
+// The longest remote wins, so path prefixes take precedence over the bare host
+func findRemoteMapping(url string, ctx RequestContext) (local, remote string, ok bool) {
+	for _, mapping := range ctx.HostMappings() {
+		if hasUrlPrefix(url, mapping.remote) && (!ok || len(mapping.remote) > len(remote)) {
+			local, remote, ok = mapping.local, mapping.remote, true
+		}
+	}
+
+	return
+}
+
+func resolveRemoteUrl(rawUrl string, resolver hostResolver) bool {
+	u, err := url.Parse(rawUrl)
+
+	if err != nil || u.Host == "" || validateRemote(u.Scheme+"://"+u.Host) != nil {
+		return false
+	}
+
+	origin := parseOrigin(strings.ToLower(u.Scheme + "://" + u.Host))
+	candidate := resolver.discoversHosts()
+
+	for _, w := range resolver.wildcardOrigins() {
+		if origin.scheme == w.scheme && origin.port == w.port && strings.HasSuffix(origin.host, w.host) {
+			candidate = true
+		}
+	}
+
+	if !candidate {
+		return false
+	}
+
+	_, ok := resolver.resolveRemote(origin.String())
+
+	return ok
+}
+
+// Replacement of all occurrences of the remote hosts in a chunk of text
+func replaceRemotes(text []byte, ctx RequestContext) (result []byte, rewritten bool) {
+	return newRemoteHostMatcher(ctx, true).replace(text)
+}
+
+// The same in the opposite direction, for content sent by the client
+func replaceLocals(text []byte, ctx RequestContext) (result []byte, rewritten bool) {
+	return newLocalHostMatcher(ctx, true).replace(text)
+}
@@ -0,0 +1,329 @@
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Ways to distinguish mappings that share a local address
+const (
+	VirtualHostByPath  = "path"
+	VirtualHostByHost  = "host"
+	VirtualHostByNipIo = "nip.io"
+)
+
+const virtualHostPathPrefix = "/_/"
+
+// Host names like foo.bar.dev.10.0.2.2.nip.io resolve to the embedded IP
+var nipIoPattern = regexp.MustCompile(`(?i)^(.+)\.(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})\.nip\.io$`)
+
+// Serves several mappings on a single local address and routes each request to
+// the matching one
+type VirtualHostServer struct {
+	local    string
+	localTLS bool
+	mode     string
+	proxies  []*ProxyServer
+	log      io.Writer
+	mutex    sync.RWMutex
+
+	server http.Server
+}
+
+func isVirtualHostMode(mode string) bool {
+	switch mode {
+	case VirtualHostByPath, VirtualHostByHost, VirtualHostByNipIo:
+		return true
+	}
+
+	return false
+}
+
+// Splits a nip.io host name into the name of the virtual host and the IP
+func parseNipIoHost(host string) (name, ip string, ok bool) {
+	match := nipIoPattern.FindStringSubmatch(host)
+
+	if match == nil {
+		return
+	}
+
+	return strings.ToLower(match[1]), match[2], true
+}
+
+// Marks the mappings that share their local address with others as virtual
+// hosts
+func virtualHostMappings(mappings []Mapping, mode string) (result []Mapping, err error) {
+	shared := make(map[string][]Mapping)
+
+	for _, m := range mappings {
+		shared[m.local] = append(shared[m.local], m)
+	}
+
+	result = make([]Mapping, 0, len(mappings))
+
+	for _, m := range mappings {
+		if group := shared[m.local]; len(group) > 1 {
+			if mode == "" {
+				err = errors.New(fmt.Sprintf("%s: local address is used by several mappings, but virtual hosting is disabled", m.local))
+				return
+			}
+
+			for _, other := range group {
+				if other.localTLS != m.localTLS {
+					err = errors.New(fmt.Sprintf("%s: virtual hosts must either all use https or none", m.local))
+					return
+				}
+			}
+
+			m.virtualHost = mode
+		}
+
+		result = append(result, m)
+	}
+
+	return
+}
+
+func (v *VirtualHostServer) ServeHTTP(outgoing http.ResponseWriter, incoming *http.Request) {
+	proxy := v.route(incoming)
+
+	if proxy == nil {
+		http.Error(outgoing, fmt.Sprintf("no virtual host for %s%s", incoming.Host, incoming.URL.Path), http.StatusNotFound)
+		return
+	}
+
+	proxy.ServeHTTP(outgoing, incoming)
+}
+
+func (v *VirtualHostServer) route(request *http.Request) *ProxyServer {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	switch v.mode {
+	case VirtualHostByPath:
+		if proxy := v.routeByPath(request.URL.EscapedPath()); proxy != nil {
+			return proxy
+		}
+
+		// Root-relative URLs built by scripts lack the prefix, but the
+		// referring page tells where they belong
+		if referer, err := url.Parse(request.Header.Get("referer")); err == nil {
+			if proxy := v.routeByPath(referer.EscapedPath()); proxy != nil {
+				return proxy
+			}
+		}
+
+	case VirtualHostByHost, VirtualHostByNipIo:
+		host := request.Host
+
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if v.mode == VirtualHostByNipIo {
+			name, _, ok := parseNipIoHost(host)
+
+			if !ok {
+				return nil
+			}
+
+			host = name
+		}
+
+		for _, proxy := range v.proxies {
+			if strings.EqualFold(host, proxy.virtualHostName) {
+				return proxy
+			}
+		}
+	}
+
+	// The onboarding pages are the same for all mappings
+	if len(v.proxies) > 0 && v.proxies[0].current().servesOnboarding(request.URL.Path) {
+		return v.proxies[0]
+	}
+
+	return nil
+}
+
+// The longest prefix wins, so foo.bar.dev/shop takes precedence over foo.bar.dev
+func (v *VirtualHostServer) routeByPath(path string) (match *ProxyServer) {
+	for _, proxy := range v.proxies {
+		if hasUrlPrefix(path, proxy.virtualHostPath) &&
+			(match == nil || len(proxy.virtualHostPath) > len(match.virtualHostPath)) {
+
+			match = proxy
+		}
+	}
+
+	return
+}
+
+func (v *VirtualHostServer) Start() <-chan error {
+	return v.run(func() error {
+		if v.localTLS {
+			return v.server.ListenAndServeTLS("", "")
+		}
+
+		return v.server.ListenAndServe()
+	})
+}
+
+// Serves on a listener that has already been opened, e.g. after a config reload
+func (v *VirtualHostServer) serve(listener net.Listener) <-chan error {
+	return v.run(func() error {
+		if v.localTLS {
+			return v.server.ServeTLS(listener, "", "")
+		}
+
+		return v.server.Serve(listener)
+	})
+}
+
+func (v *VirtualHostServer) run(serve func() error) <-chan error {
+	c := make(chan error, 1)
+
+	scheme := "http://"
+	if v.localTLS {
+		scheme = "https://"
+	}
+
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	go func() {
+		err := serve()
+
+		if err != http.ErrServerClosed {
+			v.mutex.RLock()
+			remotes := make([]string, 0, len(v.proxies))
+			for _, proxy := range v.proxies {
+				proxy.setState(proxyFailed)
+				remotes = append(remotes, proxy.remote)
+			}
+			v.mutex.RUnlock()
+
+			err = &MappingError{scheme + v.local, strings.Join(remotes, ","), err}
+		}
+
+		c <- err
+	}()
+
+	for _, proxy := range v.proxies {
+		v.logProxy(proxy)
+	}
+
+	return c
+}
+
+func (v *VirtualHostServer) logProxy(proxy *ProxyServer) {
+	scheme := "http://"
+	if v.localTLS {
+		scheme = "https://"
+	}
+
+	proxy.setState(proxyRunning)
+
+	name := proxy.virtualHostName
+	if v.mode == VirtualHostByPath {
+		name = proxy.virtualHostPath
+	}
+
+	fmt.Fprintf(v.log, "proxying requests for %s%s (virtual host %s) to %s\n", scheme, v.local, name, proxy.remote)
+}
+
+func (v *VirtualHostServer) AddProxy(p *ProxyServer) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.proxies = append(v.proxies, p)
+}
+
+// Adds a proxy to a server that is already running
+func (v *VirtualHostServer) startProxy(p *ProxyServer) {
+	v.AddProxy(p)
+	v.logProxy(p)
+}
+
+// Stops routing requests to the proxy and returns the number of remaining
+// proxies
+func (v *VirtualHostServer) RemoveProxy(p *ProxyServer) int {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	for i, proxy := range v.proxies {
+		if proxy == p {
+			v.proxies = append(v.proxies[:i:i], v.proxies[i+1:]...)
+			break
+		}
+	}
+
+	return len(v.proxies)
+}
+
+// Stops all virtual hosts like ProxyServer.Shutdown
+func (v *VirtualHostServer) Shutdown(ctx context.Context) (err error) {
+	v.setStates(proxyStopping)
+	v.eachProxy(func(p *ProxyServer) { p.websockets.closeAll() })
+
+	if err = v.server.Shutdown(ctx); err != nil {
+		v.server.Close()
+	}
+
+	v.eachProxy((*ProxyServer).closeIdleConnections)
+	v.setStates(proxyStopped)
+
+	return
+}
+
+func (v *VirtualHostServer) eachProxy(f func(p *ProxyServer)) {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	for _, proxy := range v.proxies {
+		f(proxy)
+	}
+}
+
+func (v *VirtualHostServer) setStates(state string) {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	for _, proxy := range v.proxies {
+		if proxy.State() != proxyFailed {
+			proxy.setState(state)
+		}
+	}
+}
+
+func (v *VirtualHostServer) SetCertificateAuthority(ca *CertificateAuthority) {
+	if v.localTLS {
+		v.server.TLSConfig = &tls.Config{
+			GetCertificate: ca.GetCertificate,
+		}
+	}
+}
+
+func NewVirtualHostServer(local string, localTLS bool, mode string, log io.Writer) *VirtualHostServer {
+	v := &VirtualHostServer{
+		local:    local,
+		localTLS: localTLS,
+		mode:     mode,
+		log:      log,
+	}
+
+	v.server = http.Server{
+		Addr:    local,
+		Handler: v,
+	}
+
+	return v
+}
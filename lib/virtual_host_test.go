@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newVirtualHostMappings(t *testing.T, mode string) []Mapping {
+	shop, err := NewMapping("0.0.0.0:8080", "https://shop.app.dev")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api, err := NewMapping("0.0.0.0:8080", "https://api.app.dev/v1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mappings, err := virtualHostMappings([]Mapping{shop, api}, mode)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return mappings
+}
+
+func assertLocalUrls(t *testing.T, hostMappings []HostMapping, expected ...string) {
+	for i, url := range expected {
+		if hostMappings[i].local != url {
+			t.Fatalf("expected %s, got %s", url, hostMappings[i].local)
+		}
+	}
+}
+
+func TestVirtualHostLocalUrls(t *testing.T) {
+	assertLocalUrls(t, buildHostMappings(newVirtualHostMappings(t, VirtualHostByPath), "10.0.2.2:8080"),
+		"http://10.0.2.2:8080/_/shop.app.dev", "http://10.0.2.2:8080/_/api.app.dev/v1")
+
+	assertLocalUrls(t, buildHostMappings(newVirtualHostMappings(t, VirtualHostByHost), "shop.app.dev:8080"),
+		"http://shop.app.dev:8080", "http://api.app.dev:8080")
+
+	assertLocalUrls(t, buildHostMappings(newVirtualHostMappings(t, VirtualHostByNipIo), "shop.app.dev.10.0.2.2.nip.io:8080"),
+		"http://shop.app.dev.10.0.2.2.nip.io:8080", "http://api.app.dev.10.0.2.2.nip.io:8080")
+}
+
+func TestSharedAddressRequiresVirtualHosting(t *testing.T) {
+	shop, _ := NewMapping("0.0.0.0:8080", "https://shop.app.dev")
+	api, _ := NewMapping("0.0.0.0:8080", "https://api.app.dev")
+
+	if _, err := virtualHostMappings([]Mapping{shop, api}, ""); err == nil {
+		t.Fatal("shared address without virtual hosting should be an error")
+	}
+
+	secureApi, _ := NewMapping("https://0.0.0.0:8080", "https://api.app.dev")
+
+	if _, err := virtualHostMappings([]Mapping{shop, secureApi}, VirtualHostByPath); err == nil {
+		t.Fatal("mixing http and https virtual hosts should be an error")
+	}
+}
+
+func TestVirtualHostRouting(t *testing.T) {
+	mappings := newVirtualHostMappings(t, VirtualHostByNipIo)
+	v := NewVirtualHostServer("0.0.0.0:8080", false, VirtualHostByNipIo, ioutil.Discard)
+
+	for _, m := range mappings {
+		p, err := NewProxyServer(m, mappings, ioutil.Discard, false)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v.AddProxy(p)
+	}
+
+	for host, expected := range map[string]string{
+		"shop.app.dev.10.0.2.2.nip.io:8080": "https://shop.app.dev",
+		"API.app.dev.10.0.2.2.nip.io":       "https://api.app.dev/v1",
+	} {
+		request := httptest.NewRequest("GET", "/", nil)
+		request.Host = host
+
+		if proxy := v.route(request); proxy == nil || proxy.remote != expected {
+			t.Fatalf("%s was not routed to %s", host, expected)
+		}
+	}
+
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Host = "10.0.2.2:8080"
+
+	if v.route(request) != nil {
+		t.Fatal("unknown host should not be routed")
+	}
+}
+
+func TestVirtualHostsByPath(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer other.Close()
+
+	var upstreamPath string
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamPath = r.URL.Path
+		w.Header().Set("content-type", "text/html")
+		fmt.Fprintf(w, `<a href="/next"></a><a href="%s/x"></a>`, other.URL)
+	}))
+	defer upstream.Close()
+
+	proxy := httptest.NewUnstartedServer(nil)
+	local := proxy.Listener.Addr().String()
+
+	cfg := NewConfig()
+	cfg.SetLog(ioutil.Discard)
+	cfg.AddRewriteRoute(".")
+	cfg.AddMapping(local, upstream.URL)
+	cfg.AddMapping(local, other.URL)
+
+	if err := cfg.SetVirtualHosting(VirtualHostByPath); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRepro(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.Config.Handler = r.virtualHosts[0]
+	proxy.Start()
+	defer proxy.Close()
+
+	upstreamPrefix := "/_/" + strings.TrimPrefix(upstream.URL, "http://")
+	otherPrefix := "/_/" + strings.TrimPrefix(other.URL, "http://")
+
+	response, err := http.Get(proxy.URL + upstreamPrefix + "/page")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	if upstreamPath != "/page" {
+		t.Fatalf("unexpected upstream path %s", upstreamPath)
+	}
+
+	expected := fmt.Sprintf(`<a href="%s/next"></a><a href="%s%s/x"></a>`, upstreamPrefix, proxy.URL, otherPrefix)
+
+	if string(body) != expected {
+		t.Fatalf("unexpected body %s, expected %s", body, expected)
+	}
+}
@@ -0,0 +1,404 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	websocketOpcodeContinuation = 0x0
+	websocketOpcodeText         = 0x1
+
+	websocketMaxMessageSize = 16 * 1024 * 1024
+	websocketDialTimeout    = 30 * time.Second
+)
+
+type websocketFrame struct {
+	fin     bool
+	rsv     byte
+	opcode  byte
+	masked  bool
+	mask    [4]byte
+	payload []byte
+}
+
+// Hijacked connections are neither closed nor awaited by http.Server.Shutdown,
+// so the proxy closes them itself
+type websocketConns struct {
+	mutex  sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+func newWebsocketConns() *websocketConns {
+	return &websocketConns{
+		conns: make(map[net.Conn]bool),
+	}
+}
+
+// Returns false if the proxy is already shutting down
+func (w *websocketConns) add(conn net.Conn) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return false
+	}
+
+	w.conns[conn] = true
+
+	return true
+}
+
+func (w *websocketConns) remove(conn net.Conn) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	delete(w.conns, conn)
+}
+
+func (w *websocketConns) closeAll() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.closed = true
+
+	for conn := range w.conns {
+		conn.Close()
+	}
+}
+
+func isWebsocketUpgrade(request *http.Request) bool {
+	return headerContainsToken(request.Header, "connection", "upgrade") &&
+		strings.EqualFold(request.Header.Get("upgrade"), "websocket")
+}
+
+func headerContainsToken(headers http.Header, key, token string) bool {
+	for _, value := range headers[http.CanonicalHeaderKey(key)] {
+		for _, element := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(element), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (p *ProxyServer) serveWebsocket(outgoing http.ResponseWriter, ctx *requestContext) {
+	upstreamRequest, err := p.buildUpstreamRequest(ctx)
+
+	if err == nil && p.rewriteWebsockets {
+		// We cannot rewrite compressed frames
+		upstreamRequest.Header.Del("sec-websocket-extensions")
+		ctx.Log("websocket: rewriting text frames")
+	}
+
+	var upstreamConn net.Conn
+	if err == nil {
+		upstreamConn, err = p.dialUpstream(upstreamRequest)
+	}
+
+	if err != nil {
+		fmt.Fprintf(p.log, "error during websocket handshake: %v\n", err)
+		http.Error(outgoing, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	defer upstreamConn.Close()
+
+	upstreamReader := bufio.NewReader(upstreamConn)
+
+	err = upstreamRequest.Write(upstreamConn)
+
+	if err == nil {
+		ctx.upstreamResponse, err = http.ReadResponse(upstreamReader, upstreamRequest)
+	}
+
+	if err != nil {
+		fmt.Fprintf(p.log, "error during websocket handshake: %v\n", err)
+		http.Error(outgoing, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	// The upstream declined the upgrade, so we pass on its answer
+	if ctx.upstreamResponse.StatusCode != http.StatusSwitchingProtocols {
+		p.sendResponse(outgoing, ctx)
+		return
+	}
+
+	hijacker, ok := outgoing.(http.Hijacker)
+
+	if !ok {
+		http.Error(outgoing, "connection does not support upgrades", http.StatusInternalServerError)
+		return
+	}
+
+	ctx.outgoingHeaders = make(http.Header)
+	for key, values := range ctx.upstreamResponse.Header {
+		ctx.outgoingHeaders[key] = values
+	}
+
+	p.rewriteOutgoingHeaders(ctx)
+
+	if !p.noLogging {
+		p.addLog(ctx)
+	}
+
+	clientConn, clientBuffer, err := hijacker.Hijack()
+
+	if err != nil {
+		fmt.Fprintf(p.log, "unable to hijack websocket connection: %v\n", err)
+		return
+	}
+
+	defer clientConn.Close()
+
+	if !p.websockets.add(clientConn) {
+		return
+	}
+
+	defer p.websockets.remove(clientConn)
+
+	fmt.Fprintf(clientBuffer, "HTTP/1.1 %s\r\n", ctx.upstreamResponse.Status)
+	ctx.outgoingHeaders.Write(clientBuffer)
+	clientBuffer.WriteString("\r\n")
+
+	if err = clientBuffer.Flush(); err != nil {
+		return
+	}
+
+	p.relayWebsocket(clientConn, clientBuffer.Reader, upstreamConn, upstreamReader, ctx)
+}
+
+func (p *ProxyServer) dialUpstream(request *http.Request) (conn net.Conn, err error) {
+	address := request.URL.Host
+	secure := request.URL.Scheme == "https"
+
+	if _, _, e := net.SplitHostPort(address); e != nil {
+		if secure {
+			address += ":443"
+		} else {
+			address += ":80"
+		}
+	}
+
+	dialer := &net.Dialer{
+		Timeout: websocketDialTimeout,
+	}
+
+	if !secure {
+		return dialer.Dial("tcp", address)
+	}
+
+	tlsConfig := &tls.Config{}
+	if p.tlsConfig != nil {
+		tlsConfig = p.tlsConfig.Clone()
+	}
+
+	tlsConfig.ServerName = request.URL.Hostname()
+
+	// Upgrades are not possible over HTTP/2
+	tlsConfig.NextProtos = []string{"http/1.1"}
+
+	return tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+}
+
+func (p *ProxyServer) relayWebsocket(clientConn net.Conn, clientReader io.Reader, upstreamConn net.Conn, upstreamReader io.Reader, ctx *requestContext) {
+	done := make(chan struct{}, 2)
+
+	relay := func(dst net.Conn, src io.Reader, rewrite func([]byte) []byte) {
+		if p.rewriteWebsockets {
+			relayWebsocketFrames(dst, bufio.NewReader(src), rewrite)
+		} else {
+			io.Copy(dst, src)
+		}
+
+		// Unblock the opposite direction
+		dst.Close()
+		done <- struct{}{}
+	}
+
+	go relay(upstreamConn, clientReader, func(text []byte) []byte {
+		text, _ = replaceLocals(text, ctx)
+		return text
+	})
+
+	go relay(clientConn, upstreamReader, func(text []byte) []byte {
+		text, _ = replaceRemotes(text, ctx)
+		return text
+	})
+
+	<-done
+	clientConn.Close()
+	upstreamConn.Close()
+	<-done
+}
+
+// Copies websocket frames from src to dst, applying rewrite to text messages.
+// Fragmented text messages are reassembled in order to catch URLs spanning
+// fragment boundaries, control frames are passed on immediately.
+func relayWebsocketFrames(dst io.Writer, src *bufio.Reader, rewrite func([]byte) []byte) error {
+	var message *websocketFrame
+
+	for {
+		frame, err := readWebsocketFrame(src)
+
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case frame.opcode == websocketOpcodeText && frame.fin:
+			frame.payload = rewrite(frame.payload)
+
+		case frame.opcode == websocketOpcodeText:
+			message = frame
+			continue
+
+		case frame.opcode == websocketOpcodeContinuation && message != nil:
+			message.payload = append(message.payload, frame.payload...)
+
+			if len(message.payload) > websocketMaxMessageSize {
+				return errors.New("websocket message too large")
+			}
+
+			if !frame.fin {
+				continue
+			}
+
+			frame = message
+			frame.fin = true
+			frame.payload = rewrite(frame.payload)
+			message = nil
+		}
+
+		if err = frame.write(dst); err != nil {
+			return err
+		}
+	}
+}
+
+func readWebsocketFrame(src *bufio.Reader) (frame *websocketFrame, err error) {
+	var header [2]byte
+
+	if _, err = io.ReadFull(src, header[:]); err != nil {
+		return
+	}
+
+	frame = &websocketFrame{
+		fin:    header[0]&0x80 != 0,
+		rsv:    header[0] & 0x70,
+		opcode: header[0] & 0x0f,
+		masked: header[1]&0x80 != 0,
+	}
+
+	length := uint64(header[1] & 0x7f)
+
+	switch length {
+	case 126:
+		var extended [2]byte
+		_, err = io.ReadFull(src, extended[:])
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+
+	case 127:
+		var extended [8]byte
+		_, err = io.ReadFull(src, extended[:])
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+
+	if err != nil {
+		return
+	}
+
+	if length > websocketMaxMessageSize {
+		err = errors.New("websocket frame too large")
+		return
+	}
+
+	if frame.masked {
+		if _, err = io.ReadFull(src, frame.mask[:]); err != nil {
+			return
+		}
+	}
+
+	frame.payload = make([]byte, length)
+
+	if _, err = io.ReadFull(src, frame.payload); err != nil {
+		return
+	}
+
+	if frame.masked {
+		maskWebsocketPayload(frame.payload, frame.mask)
+	}
+
+	return
+}
+
+func (f *websocketFrame) write(dst io.Writer) (err error) {
+	var header bytes.Buffer
+
+	first := f.rsv | f.opcode
+	if f.fin {
+		first |= 0x80
+	}
+
+	header.WriteByte(first)
+
+	maskBit := byte(0)
+	if f.masked {
+		maskBit = 0x80
+	}
+
+	length := len(f.payload)
+
+	switch {
+	case length < 126:
+		header.WriteByte(maskBit | byte(length))
+
+	case length <= 0xffff:
+		header.WriteByte(maskBit | 126)
+		binary.Write(&header, binary.BigEndian, uint16(length))
+
+	default:
+		header.WriteByte(maskBit | 127)
+		binary.Write(&header, binary.BigEndian, uint64(length))
+	}
+
+	payload := f.payload
+
+	if f.masked {
+		// Frames from the client have to be masked, use a fresh key
+		if _, err = rand.Read(f.mask[:]); err != nil {
+			return
+		}
+
+		header.Write(f.mask[:])
+
+		payload = append([]byte(nil), f.payload...)
+		maskWebsocketPayload(payload, f.mask)
+	}
+
+	if _, err = dst.Write(header.Bytes()); err == nil {
+		_, err = dst.Write(payload)
+	}
+
+	return
+}
+
+func maskWebsocketPayload(payload []byte, mask [4]byte) {
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+}
@@ -0,0 +1,228 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebsocketFrameRoundtrip(t *testing.T) {
+	for _, length := range []int{5, 300, 70000} {
+		frame := &websocketFrame{
+			fin:     true,
+			opcode:  websocketOpcodeText,
+			masked:  true,
+			payload: bytes.Repeat([]byte("x"), length),
+		}
+
+		var buffer bytes.Buffer
+
+		if err := frame.write(&buffer); err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := readWebsocketFrame(bufio.NewReader(&buffer))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !parsed.fin || !parsed.masked || parsed.opcode != websocketOpcodeText || !bytes.Equal(parsed.payload, frame.payload) {
+			t.Fatalf("frame of length %d did not survive roundtrip", length)
+		}
+	}
+}
+
+func TestWebsocketFragmentedRewrite(t *testing.T) {
+	var in, out bytes.Buffer
+
+	(&websocketFrame{opcode: websocketOpcodeText, payload: []byte("go to http://fo")}).write(&in)
+	(&websocketFrame{opcode: 0x9, fin: true, payload: []byte("ping")}).write(&in)
+	(&websocketFrame{opcode: websocketOpcodeContinuation, fin: true, payload: []byte("o.bar/x")}).write(&in)
+
+	relayWebsocketFrames(&out, bufio.NewReader(&in), func(text []byte) []byte {
+		return bytes.Replace(text, []byte("http://foo.bar"), []byte("http://1.2.3.4:8888"), -1)
+	})
+
+	reader := bufio.NewReader(&out)
+
+	ping, err := readWebsocketFrame(reader)
+
+	if err != nil || ping.opcode != 0x9 {
+		t.Fatal("control frame should be passed on immediately")
+	}
+
+	message, err := readWebsocketFrame(reader)
+
+	if err != nil || !message.fin || string(message.payload) != "go to http://1.2.3.4:8888/x" {
+		t.Fatalf("fragmented message not rewritten: %v", message)
+	}
+}
+
+func TestWebsocketProxy(t *testing.T) {
+	received := make(chan string, 1)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buffer, err := w.(http.Hijacker).Hijack()
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		buffer.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buffer.Flush()
+
+		frame, err := readWebsocketFrame(buffer.Reader)
+
+		if err != nil {
+			return
+		}
+
+		received <- string(frame.payload)
+
+		(&websocketFrame{fin: true, opcode: websocketOpcodeText, payload: []byte("back to http://foo.bar/y")}).write(conn)
+	}))
+	defer upstream.Close()
+
+	local, _ := NewMapping("127.0.0.1:8080", strings.Replace(upstream.URL, "http://", "ws://", 1))
+	foo, _ := NewMapping("127.0.0.1:8081", "http://foo.bar")
+
+	p, err := NewProxyServer(local, []Mapping{local, foo}, ioutil.Discard, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.SetRewriteWebsockets(true)
+
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.Write([]byte("GET /socket HTTP/1.1\r\nHost: 127.0.0.1:8080\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade failed with status %d", response.StatusCode)
+	}
+
+	(&websocketFrame{fin: true, opcode: websocketOpcodeText, masked: true, payload: []byte("hello http://127.0.0.1:8081/x")}).write(conn)
+
+	if message := <-received; message != "hello http://foo.bar/x" {
+		t.Fatalf("upstream received %s", message)
+	}
+
+	frame, err := readWebsocketFrame(reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(frame.payload) != "back to http://127.0.0.1:8081/y" {
+		t.Fatalf("client received %s", frame.payload)
+	}
+}
+
+func TestWebsocketShutdown(t *testing.T) {
+	closed := make(chan bool, 1)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buffer, err := w.(http.Hijacker).Hijack()
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		buffer.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buffer.Flush()
+
+		io.Copy(ioutil.Discard, buffer)
+		closed <- true
+	}))
+	defer upstream.Close()
+
+	address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	local, _ := NewMapping(address, strings.Replace(upstream.URL, "http://", "ws://", 1))
+
+	p, err := NewProxyServer(local, []Mapping{local}, ioutil.Discard, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+
+	go func() {
+		stopped <- p.Run(ctx, 5*time.Second)
+	}()
+
+	waitForListener(t, address, true)
+
+	conn, err := net.Dial("tcp", address)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	conn.Write([]byte("GET /socket HTTP/1.1\r\nHost: " + address + "\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+
+	if err != nil || response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade failed: %v", err)
+	}
+
+	cancel()
+
+	select {
+	case err = <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown did not complete")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err = reader.ReadByte(); err != io.EOF {
+		t.Fatalf("client connection should be closed, got %v", err)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream connection should be closed")
+	}
+}
@@ -0,0 +1,149 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Maps all remotes matching a pattern like https://*.app.dev to ports from a
+// local range. The wildcard matches a single DNS label, the ports are
+// allocated when a host is first referenced.
+type WildcardMapping struct {
+	ports portRange
+
+	scheme string
+	suffix string
+	port   string
+}
+
+// Local ports for mappings that are created at runtime
+type portRange struct {
+	host      string
+	firstPort int
+	lastPort  int
+	localTLS  bool
+}
+
+// Port ranges are written as [https://]ip:first-last
+func parsePortRange(local string) (r portRange, err error) {
+	address, localTLS, err := parseLocal(local)
+
+	if err != nil {
+		return
+	}
+
+	i := strings.LastIndex(address, ":")
+	ports := strings.SplitN(address[i+1:], "-", 2)
+
+	if i < 0 || len(ports) != 2 {
+		err = errors.New(fmt.Sprintf("%s: local address must have a port range", local))
+		return
+	}
+
+	r.host = address[:i]
+	r.localTLS = localTLS
+
+	r.firstPort, err = strconv.Atoi(ports[0])
+
+	if err == nil {
+		r.lastPort, err = strconv.Atoi(ports[1])
+	}
+
+	if err != nil || r.firstPort < 1 || r.lastPort > 65535 || r.firstPort > r.lastPort {
+		err = errors.New(fmt.Sprintf("%s: invalid port range", local))
+	}
+
+	return
+}
+
+func (r *portRange) String() string {
+	scheme := ""
+	if r.localTLS {
+		scheme = "https://"
+	}
+
+	return fmt.Sprintf("%s%s:%d-%d", scheme, r.host, r.firstPort, r.lastPort)
+}
+
+func NewWildcardMapping(local, remote string) (w WildcardMapping, err error) {
+	w.ports, err = parsePortRange(local)
+
+	if err != nil {
+		return
+	}
+
+	remote = strings.TrimRight(remote, "/")
+
+	if err = validateRemote(remote); err != nil {
+		return
+	}
+
+	u, _ := url.Parse(remote)
+
+	if !strings.HasPrefix(u.Hostname(), "*.") || strings.Contains(u.Hostname()[1:], "*") {
+		err = errors.New(fmt.Sprintf("%s: remote host must start with *.", remote))
+		return
+	}
+
+	if u.Path != "" {
+		err = errors.New(fmt.Sprintf("%s: wildcard remotes must not have a path", remote))
+		return
+	}
+
+	w.scheme = strings.ToLower(u.Scheme)
+	w.suffix = strings.ToLower(u.Hostname()[1:])
+	w.port = u.Port()
+
+	return
+}
+
+// Checks whether the origin scheme://host[:port] is covered by the wildcard
+func (w *WildcardMapping) matches(remote string) bool {
+	o := parseOrigin(remote)
+
+	return o.scheme == w.scheme && o.port == w.port && o.path == "" && w.matchesHost(o.host)
+}
+
+func (w *WildcardMapping) matchesHost(host string) bool {
+	host = strings.ToLower(host)
+
+	if !strings.HasSuffix(host, w.suffix) || len(host) == len(w.suffix) {
+		return false
+	}
+
+	for _, c := range []byte(host[:len(host)-len(w.suffix)]) {
+		if !isHostChar(c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (w *WildcardMapping) origin() urlOrigin {
+	return urlOrigin{
+		scheme: w.scheme,
+		host:   w.suffix,
+		port:   w.port,
+	}
+}
+
+func (w *WildcardMapping) String() string {
+	remote := w.scheme + "://*" + w.suffix
+	if w.port != "" {
+		remote += ":" + w.port
+	}
+
+	return w.ports.String() + "=" + remote
+}
+
+// Implemented by request contexts that are able to map remotes on demand,
+// either because they match a wildcard or because of host discovery
+type hostResolver interface {
+	wildcardOrigins() []urlOrigin
+	discoversHosts() bool
+	resolveRemote(remote string) (local string, ok bool)
+}
@@ -0,0 +1,135 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWildcardMappingSyntax(t *testing.T) {
+	w, err := NewWildcardMapping("https://0.0.0.0:9000-9099", "https://*.app.dev")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !w.ports.localTLS || w.ports.firstPort != 9000 || w.ports.lastPort != 9099 {
+		t.Fatalf("unexpected local side %s", w.String())
+	}
+
+	if !w.matches("https://feature-123.app.dev") {
+		t.Fatal("wildcard should match a single label")
+	}
+
+	for _, remote := range []string{"https://a.feature-123.app.dev", "https://app.dev", "http://feature-123.app.dev", "https://feature-123.app.dev:8443"} {
+		if w.matches(remote) {
+			t.Fatalf("wildcard should not match %s", remote)
+		}
+	}
+
+	for _, def := range [][2]string{
+		{"0.0.0.0:9000", "https://*.app.dev"},
+		{"0.0.0.0:9099-9000", "https://*.app.dev"},
+		{"0.0.0.0:9000-9099", "https://app.dev"},
+		{"0.0.0.0:9000-9099", "https://*.app.dev/path"},
+	} {
+		if _, err := NewWildcardMapping(def[0], def[1]); err == nil {
+			t.Fatalf("%s=%s should be an error", def[0], def[1])
+		}
+	}
+}
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestWildcardMappingOnDemand(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html")
+		w.Header().Set("location", "http://feature-2.app.test/")
+		fmt.Fprint(w, `<a href="http://feature-1.app.test/x"></a><a href="http://feature-1.app.test/y"></a>`)
+	}))
+	defer upstream.Close()
+
+	proxy := httptest.NewUnstartedServer(nil)
+	port := freePort(t)
+
+	cfg := NewConfig()
+	cfg.SetLog(ioutil.Discard)
+	cfg.AddRewriteRoute(".")
+	cfg.AddMapping(proxy.Listener.Addr().String(), upstream.URL)
+
+	if err := cfg.AddWildcardMapping(fmt.Sprintf("127.0.0.1:%d-%d", port, port+10), "http://*.app.test"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRepro(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		for _, p := range r.proxies[1:] {
+			p.server.Close()
+		}
+	}()
+
+	proxy.Config.Handler = r.proxies[0]
+	proxy.Start()
+	defer proxy.Close()
+
+	response, err := http.Get(proxy.URL + "/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	mappings := r.registry.Mappings()
+
+	if len(mappings) != 3 {
+		t.Fatalf("expected two mappings to be allocated, got %v", mappings)
+	}
+
+	local := make(map[string]string)
+	for _, m := range mappings[1:] {
+		local[m.remote] = "http://" + m.local
+	}
+
+	expected := fmt.Sprintf(`<a href="%s/x"></a><a href="%s/y"></a>`, local["http://feature-1.app.test"], local["http://feature-1.app.test"])
+
+	if string(body) != expected {
+		t.Fatalf("unexpected body %s, expected %s", body, expected)
+	}
+
+	if location := response.Header.Get("location"); location != local["http://feature-2.app.test"]+"/" {
+		t.Fatalf("unexpected location %s", location)
+	}
+
+	// The new proxy is up and tries to reach the upstream
+	response, err = http.Get(local["http://feature-1.app.test"] + "/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusBadGateway {
+		t.Fatalf("unexpected status %d", response.StatusCode)
+	}
+}